@@ -15,106 +15,307 @@ package convert
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"errors"
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/schema"
 )
 
-func buildACI(dir string) (string, error) {
+// Build the aci of the layout in dir next to it, and return its path and
+// image ID
+func (c *Converter) buildACI(ctx context.Context, dir string) (string, string, error) {
 	imageName, err := filepath.Abs(dir)
 	if err != nil {
-		logrus.Fatalf("err: %v", err)
+		return "", "", &BuildError{Op: "resolve", Path: dir, Err: err}
 	}
 	imageName += ".aci"
-	err = createACI(dir, imageName)
-
-	return imageName, err
+	imageID, err := c.createACI(ctx, dir, imageName)
+	if err != nil {
+		return imageName, "", err
+	}
+	if err := c.verifyImage(ctx, imageName); err != nil {
+		if _, ok := err.(*ValidationError); ok {
+			err = &BuildError{Op: "verify image", Path: imageName, Err: err}
+		}
+		return imageName, "", err
+	}
+	return imageName, imageID, nil
 }
 
-func createACI(dir string, imageName string) error {
-	var errStr string
-	var errRes error
-	buildNocompress := true
-	root := dir
-	tgt := imageName
-
-	ext := filepath.Ext(tgt)
-	if ext != schema.ACIExtension {
-		errStr = fmt.Sprintf("build: Extension must be %s (given %s)", schema.ACIExtension, ext)
-		errRes = errors.New(errStr)
-		return errRes
+// Write the aci of the layout in dir to imageName, and return its image ID
+func (c *Converter) createACI(ctx context.Context, dir string, imageName string) (imageID string, err error) {
+	if ext := filepath.Ext(imageName); ext != schema.ACIExtension {
+		return "", &BuildError{Op: "create image", Path: imageName, Err: fmt.Errorf("extension must be %s (given %s)", schema.ACIExtension, ext)}
 	}
 
-	if err := aci.ValidateLayout(root); err != nil {
+	if err := aci.ValidateLayout(dir); err != nil {
 		if e, ok := err.(aci.ErrOldVersion); ok {
-			logrus.Debugf("build: Warning: %v. Please update your manifest.", e)
+			c.logger.Debugf("build: Warning: %v. Please update your manifest.", e)
 		} else {
-			errStr = fmt.Sprintf("build: Layout failed validation: %v", err)
-			errRes = errors.New(errStr)
-			return errRes
+			return "", &BuildError{Op: "validate layout", Path: dir, Err: err}
 		}
 	}
 
-	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-	fh, err := os.OpenFile(tgt, mode, 0644)
+	mpath := filepath.Join(dir, aci.ManifestFile)
+	b, err := ioutil.ReadFile(mpath)
 	if err != nil {
-		errStr = fmt.Sprintf("build: Unable to open target %s: %v", tgt, err)
-		errRes = errors.New(errStr)
-		return errRes
+		return "", &BuildError{Op: "read image manifest", Path: mpath, Err: err}
 	}
-
-	var gw *gzip.Writer
-	var r io.WriteCloser = fh
-	if !buildNocompress {
-		gw = gzip.NewWriter(fh)
-		r = gw
+	var im schema.ImageManifest
+	if err := im.UnmarshalJSON(b); err != nil {
+		return "", &SpecError{File: mpath, Err: err}
 	}
-	tr := tar.NewWriter(r)
 
+	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	fh, err := os.OpenFile(imageName, mode, 0644)
+	if err != nil {
+		return "", &BuildError{Op: "open target", Path: imageName, Err: err}
+	}
 	defer func() {
-		tr.Close()
-		if !buildNocompress {
-			gw.Close()
+		if cerr := fh.Close(); cerr != nil && err == nil {
+			err = &BuildError{Op: "close image", Path: imageName, Err: cerr}
 		}
-		fh.Close()
 	}()
 
-	mpath := filepath.Join(root, aci.ManifestFile)
-	b, err := ioutil.ReadFile(mpath)
+	return c.writeACI(ctx, fh, im, filepath.Join(dir, "rootfs"), nil, imageName)
+}
+
+// A file generated for the aci rootfs, Path is the path inside the image
+type aciFile struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// Write the generated files to the rootfs of an aci layout. A file of the
+// rootfs at the same path is replaced, not written to, as it may be a hard
+// link. The generated files and directories get the build time and the
+// directories of the rootfs keep theirs, so the aci doesn't depend on when
+// the layout is written.
+func writeACIFiles(rootfs string, files []aciFile) error {
+	mtimes := map[string]time.Time{}
+	for _, f := range files {
+		path := filepath.Join(rootfs, f.Path)
+		for dir := filepath.Dir(path); len(dir) >= len(rootfs); dir = filepath.Dir(dir) {
+			if _, ok := mtimes[dir]; ok {
+				break
+			}
+			fi, err := os.Stat(dir)
+			switch {
+			case err == nil:
+				mtimes[dir] = fi.ModTime()
+			case os.IsNotExist(err):
+				mtimes[dir] = buildTime
+			default:
+				return &BuildError{Op: "write file", Path: path, Err: err}
+			}
+			if dir == rootfs {
+				break
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return &BuildError{Op: "write file", Path: path, Err: err}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return &BuildError{Op: "write file", Path: path, Err: err}
+		}
+		if err := ioutil.WriteFile(path, f.Data, f.Mode); err != nil {
+			return &BuildError{Op: "write file", Path: path, Err: err}
+		}
+		if err := os.Chtimes(path, buildTime, buildTime); err != nil {
+			return &BuildError{Op: "write file", Path: path, Err: err}
+		}
+	}
+	for dir, mtime := range mtimes {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			return &BuildError{Op: "write file", Path: dir, Err: err}
+		}
+	}
+	return nil
+}
+
+// Write the aci of the manifest im, the directory rootfs and the generated
+// files to w, compressed if the converter compresses, and return its image
+// ID. A file of the directory is replaced by the generated file of the same
+// path. name is the image in the errors, w is not closed. The same rootfs,
+// files and manifest give the same aci.
+func (c *Converter) writeACI(ctx context.Context, w io.Writer, im schema.ImageManifest, rootfs string, files []aciFile, name string) (imageID string, errRes error) {
+	entries, err := walkRootfs(ctx, rootfs, c.jobs)
 	if err != nil {
-		errStr = fmt.Sprintf("build: Unable to read Image Manifest: %v", err)
-		errRes = errors.New(errStr)
-		return errRes
+		return "", &BuildError{Op: "walk rootfs", Path: rootfs, Err: err}
 	}
-	var im schema.ImageManifest
-	if err := im.UnmarshalJSON(b); err != nil {
-		errStr = fmt.Sprintf("build: Unable to load Image Manifest: %v", err)
-		errRes = errors.New(errStr)
-		return errRes
+	totalFiles := int64(len(entries) + len(files))
+	var totalBytes int64
+	for _, e := range entries {
+		if e.info.Mode().IsRegular() {
+			totalBytes += e.info.Size()
+		}
 	}
-	iw := aci.NewImageWriter(im, tr)
+	for _, f := range files {
+		totalBytes += int64(len(f.Data))
+	}
+	c.progress(Progress{Phase: PhaseBuild, TotalFiles: totalFiles, TotalBytes: totalBytes})
 
-	err = filepath.Walk(root, aci.BuildWalker(root, iw, nil))
+	// The tar is hashed for the image ID while it is compressed
+	cw := &countingWriter{w: w}
+	zw, err := c.compressor(ctx, cw)
 	if err != nil {
-		errStr = fmt.Sprintf("build: Error walking rootfs: %v", err)
-		errRes = errors.New(errStr)
-		return errRes
+		return "", &BuildError{Op: "compress image", Path: name, Err: err}
+	}
+	hw := newHashWriter(zw)
+	bw := bufio.NewWriterSize(hw, 1<<20)
+	tr := tar.NewWriter(bw)
+
+	// The image is only complete once every writer is flushed
+	defer func() {
+		if err := tr.Close(); err != nil && errRes == nil {
+			errRes = &BuildError{Op: "close image", Path: name, Err: err}
+		}
+		if err := bw.Flush(); err != nil && errRes == nil {
+			errRes = &BuildError{Op: "write image", Path: name, Err: err}
+		}
+		if err := zw.Close(); err != nil && errRes == nil {
+			errRes = &BuildError{Op: "compress image", Path: name, Err: err}
+		}
+		imageID = hw.imageID()
+		if errRes != nil {
+			imageID = ""
+		}
+	}()
+
+	iw := &imageWriter{tw: tr, manifest: im}
+
+	// Hard links are only made to the entries kept
+	root := filepath.Dir(rootfs)
+	keep := c.rootfsFilter(rootfs, files)
+	var risky riskyFiles
+	walkFunc := func(hdr *tar.Header) bool {
+		if !keep(hdr) {
+			return false
+		}
+		c.checkRisky(hdr, imagePath(hdr), &risky)
+		return true
+	}
+	l := newLinker(c.dedup)
+
+	// Stop at the next file once ctx is done, and report every file walked
+	var nfiles, size int64
+	report := func(n int64) {
+		nfiles++
+		size += n
+		c.progress(Progress{
+			Phase:      PhaseBuild,
+			Files:      nfiles,
+			TotalFiles: totalFiles,
+			Bytes:      size,
+			TotalBytes: totalBytes,
+			Written:    cw.written(),
+		})
+	}
+	if err := c.addEntries(ctx, iw, entries, root, l, walkFunc, report); err != nil {
+		return "", &BuildError{Op: "walk rootfs", Path: rootfs, Err: err}
+	}
+
+	c.reportRisky(&risky)
+	if l.links != 0 {
+		c.logger.Debugf("%d hard links in the rootfs", l.links)
+	}
+	if l.dups != 0 {
+		c.logger.Debugf("%d duplicate files stored as hard links, %d bytes saved", l.dups, l.saved)
+	}
+
+	if err := addACIFiles(iw, files, rootfs); err != nil {
+		return "", &BuildError{Op: "write image", Path: name, Err: err}
+	}
+	for _, f := range files {
+		report(int64(len(f.Data)))
 	}
 
 	err = iw.Close()
 	if err != nil {
-		errStr = fmt.Sprintf("build: Unable to close image %s: %v", tgt, err)
-		errRes = errors.New(errStr)
-		return errRes
+		return "", &BuildError{Op: "close image", Path: name, Err: err}
 	}
 
+	return "", nil
+}
+
+// Return the callback of aci.BuildWalker which names the entries of the
+// directory rootfs "rootfs/..." in the image whatever its name, and keeps
+// the ones neither the generated files shadow nor the filter of the
+// converter leaves out. The filter keeps the directories of the generated
+// files.
+func (c *Converter) rootfsFilter(rootfs string, files []aciFile) aci.TarHeaderWalkFunc {
+	generated := map[string]bool{}
+	generatedDirs := map[string]bool{}
+	for _, f := range files {
+		generated[filepath.Join("rootfs", f.Path)] = true
+		for dir := path.Dir(path.Clean("/" + f.Path)); dir != "/"; dir = path.Dir(dir) {
+			generatedDirs[dir] = true
+		}
+	}
+	prefix := filepath.Base(rootfs)
+	return func(hdr *tar.Header) bool {
+		p := path.Clean("/" + strings.TrimPrefix(hdr.Name, prefix))
+		hdr.Name = filepath.Join("rootfs", p)
+		if generated[hdr.Name] {
+			return false
+		}
+		return p == "/" || generatedDirs[p] || c.filter.keep(p, hdr.Typeflag == tar.TypeDir)
+	}
+}
+
+// Return the path inside the rootfs of an entry of the image
+func imagePath(hdr *tar.Header) string {
+	return path.Clean("/" + strings.TrimPrefix(hdr.Name, RootfsDir))
+}
+
+// Add the generated files to the image, with the parent directories
+// missing in rootfs
+func addACIFiles(iw aci.ArchiveWriter, files []aciFile, rootfs string) error {
+	dirs := map[string]bool{}
+	for _, f := range files {
+		var parents []string
+		for dir := filepath.Dir(f.Path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			if fi, err := os.Stat(filepath.Join(rootfs, dir)); err == nil && fi.IsDir() {
+				continue
+			}
+			hdr := &tar.Header{
+				Name:     filepath.Join("rootfs", dir),
+				Mode:     0755,
+				Typeflag: tar.TypeDir,
+				ModTime:  buildTime,
+			}
+			if err := iw.AddFile(hdr, nil); err != nil {
+				return err
+			}
+		}
+		hdr := &tar.Header{
+			Name:     filepath.Join("rootfs", f.Path),
+			Mode:     int64(f.Mode.Perm()),
+			Size:     int64(len(f.Data)),
+			Typeflag: tar.TypeReg,
+			ModTime:  buildTime,
+		}
+		if err := iw.AddFile(hdr, bytes.NewReader(f.Data)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
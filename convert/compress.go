@@ -0,0 +1,287 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Compression is the format an aci is compressed with
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	// Compressed by the xz command, as acis are decompressed by the appc
+	// tools
+	CompressionXz Compression = "xz"
+)
+
+const (
+	// Blocks of the input compressed in parallel. Their size doesn't depend
+	// on the number of jobs, so neither does the output.
+	gzipBlockSize = 1 << 20
+	xzBlockSize   = "8MiB"
+	// Window of deflate, the end of a block is the dictionary of the next
+	gzipDictSize = 32 << 10
+)
+
+// WithCompressionFormat sets the format the aci is compressed with
+func WithCompressionFormat(format Compression) Option {
+	return func(c *Converter) error {
+		switch format {
+		case CompressionNone, CompressionGzip, CompressionXz:
+		default:
+			return fmt.Errorf("invalid compression %q, expected %q, %q or %q", format,
+				CompressionNone, CompressionGzip, CompressionXz)
+		}
+		c.compression = format
+		return nil
+	}
+}
+
+// WithJobs sets how many files are read and how many blocks are compressed
+// at once while building the aci, the number of CPUs if n is 0. The aci is
+// the same whatever the number.
+func WithJobs(n int) Option {
+	return func(c *Converter) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of jobs %d", n)
+		}
+		if n == 0 {
+			n = runtime.NumCPU()
+		}
+		c.jobs = n
+		return nil
+	}
+}
+
+// Return a writer compressing to w in the format of the converter. Closing
+// it completes the compressed stream but doesn't close w.
+func (c *Converter) compressor(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	switch c.compression {
+	case CompressionGzip:
+		return newParallelGzip(w, c.jobs), nil
+	case CompressionXz:
+		return newXzWriter(ctx, w, c.jobs)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// A block of a parallel gzip stream being compressed
+type gzipBlock struct {
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// A gzip writer compressing blocks of its input in parallel, as pigz does:
+// a block is deflated with the end of the previous one as dictionary and
+// ends with a sync flush, so the deflated blocks put together are one
+// deflate stream. Only the goroutine calling Write and Close writes to w.
+type parallelGzip struct {
+	w    io.Writer
+	jobs int
+	// Input of the next block, and the end of the previous one
+	buf  []byte
+	dict []byte
+	// Blocks being compressed, in the order of the input
+	pending []*gzipBlock
+	crc     uint32
+	size    uint32
+	started bool
+	err     error
+}
+
+func newParallelGzip(w io.Writer, jobs int) *parallelGzip {
+	return &parallelGzip{w: w, jobs: jobs, buf: make([]byte, 0, gzipBlockSize)}
+}
+
+func (z *parallelGzip) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+	n := 0
+	for len(p) != 0 {
+		k := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+k]
+		p = p[k:]
+		n += k
+		if len(z.buf) == cap(z.buf) {
+			if err := z.flushBlock(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Start compressing the buffered input as a block, once fewer blocks than
+// jobs are pending
+func (z *parallelGzip) flushBlock(last bool) error {
+	if !z.started {
+		// Magic, deflate, no flags, no modification time, unknown OS
+		header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+		if _, err := z.w.Write(header); err != nil {
+			z.err = err
+			return err
+		}
+		z.started = true
+	}
+	for len(z.pending) >= z.jobs {
+		if err := z.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	data, dict := z.buf, z.dict
+	b := &gzipBlock{done: make(chan struct{})}
+	z.pending = append(z.pending, b)
+	go func() {
+		defer close(b.done)
+		fw, err := flate.NewWriterDict(&b.out, flate.DefaultCompression, dict)
+		if err != nil {
+			b.err = err
+			return
+		}
+		if _, err := fw.Write(data); err != nil {
+			b.err = err
+			return
+		}
+		if last {
+			b.err = fw.Close()
+		} else {
+			b.err = fw.Flush()
+		}
+	}()
+
+	if len(data) > gzipDictSize {
+		z.dict = data[len(data)-gzipDictSize:]
+	} else {
+		z.dict = append(z.dict, data...)
+		if len(z.dict) > gzipDictSize {
+			z.dict = z.dict[len(z.dict)-gzipDictSize:]
+		}
+	}
+	z.buf = make([]byte, 0, gzipBlockSize)
+	return nil
+}
+
+// Write the oldest pending block to w once it is compressed
+func (z *parallelGzip) writeBlock() error {
+	b := z.pending[0]
+	z.pending = z.pending[1:]
+	<-b.done
+	if b.err != nil {
+		z.err = b.err
+		return b.err
+	}
+	if _, err := z.w.Write(b.out.Bytes()); err != nil {
+		z.err = err
+		return err
+	}
+	return nil
+}
+
+// Close compresses the rest of the input and writes the gzip trailer
+func (z *parallelGzip) Close() error {
+	if z.err != nil {
+		// Let the blocks being compressed finish
+		for _, b := range z.pending {
+			<-b.done
+		}
+		return z.err
+	}
+	if err := z.flushBlock(true); err != nil {
+		return z.Close()
+	}
+	for len(z.pending) != 0 {
+		if err := z.writeBlock(); err != nil {
+			return z.Close()
+		}
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, err := z.w.Write(trailer)
+	return err
+}
+
+// A writer compressing with the xz command
+type xzWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func newXzWriter(ctx context.Context, w io.Writer, jobs int) (*xzWriter, error) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		return nil, fmt.Errorf("xz compression needs the xz command: %v", err)
+	}
+	// Blocks of the same size are compressed in parallel, but xz switches
+	// to a mode with another output with a single thread
+	if jobs < 2 {
+		jobs = 2
+	}
+	xw := &xzWriter{}
+	xw.cmd = exec.CommandContext(ctx, "xz", "--compress", "--stdout",
+		"--threads="+strconv.Itoa(jobs), "--block-size="+xzBlockSize)
+	xw.cmd.Stdout = w
+	xw.cmd.Stderr = &xw.stderr
+	stdin, err := xw.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	xw.stdin = stdin
+	if err := xw.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+func (xw *xzWriter) Write(p []byte) (int, error) {
+	return xw.stdin.Write(p)
+}
+
+// Close waits for xz to write the end of the stream
+func (xw *xzWriter) Close() error {
+	xw.stdin.Close()
+	if err := xw.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(xw.stderr.String()); msg != "" {
+			return fmt.Errorf("xz: %v: %s", err, msg)
+		}
+		return fmt.Errorf("xz: %v", err)
+	}
+	return nil
+}
@@ -14,8 +14,8 @@
 package convert
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -42,42 +42,50 @@ type ResourceCPU struct {
 	Limit string `json:"limit"`
 }
 
-var manifestName string
+type IsolatorReadOnlyRootfs struct {
+	ReadOnly bool `json:"readOnly"`
+}
 
-func Oci2aciManifest(ociPath string) (string, error) {
-	if bValidate := validateOCIProc(ociPath); bValidate != true {
-		err := errors.New("Invalid oci bundle.")
-		return "", err
-	}
+type IsolatorSELinuxContext struct {
+	User  string `json:"user"`
+	Role  string `json:"role"`
+	Type  string `json:"type"`
+	Level string `json:"level"`
+}
 
-	dirWork := createWorkDir()
-	// convert layout
-	aciManifestPath, err := convertLayout(ociPath, dirWork)
+const (
+	// Name of the appc isolator carrying the SELinux process context
+	SELinuxContextName = "os/linux/selinux-context"
+	// Name of the annotation carrying the AppArmor profile, appc has no
+	// isolator for it
+	AppArmorProfileName = "os/linux/apparmor-profile"
+	// Name of the isolator signalling a read-only rootfs, it is not part
+	// of the appc spec so runtimes are free to ignore it
+	ReadOnlyRootfsName = "os/linux/read-only-rootfs"
+	// Name of the annotation carrying the hostname of config.json
+	HostnameName = "hostname"
+	// Name of the annotation carrying the oci spec version of the bundle
+	OCIVersionName = "oci-version"
+)
+
+// Oci2aciManifest converts the oci bundle in ociPath to an aci layout with
+// the default settings and returns the path of its manifest
+func Oci2aciManifest(ociPath string) (string, error) {
+	c, err := NewConverter()
 	if err != nil {
 		return "", err
 	}
-	return aciManifestPath, err
-
+	return c.Manifest(ociPath)
 }
 
+// Oci2aciImage converts the oci bundle in ociPath to an aci image with the
+// default settings and returns its path
 func Oci2aciImage(ociPath string) (string, error) {
-	if bValidate := validateOCIProc(ociPath); bValidate != true {
-		err := errors.New("Invalid oci bundle.")
-		return "", err
-	}
-
-	dirWork := createWorkDir()
-	// First, convert layout
-	_, err := convertLayout(ociPath, dirWork)
+	c, err := NewConverter()
 	if err != nil {
 		return "", err
 	}
-
-	// Second, build image
-	aciImgPath, err := buildACI(dirWork)
-
-	return aciImgPath, err
-
+	return c.Image(ociPath)
 }
 
 // Entry point of oci2aci,
@@ -90,12 +98,6 @@ func RunOCI2ACI(args []string, flagDebug bool, flagName string) error {
 		dstPath = ""
 	} else {
 		dstPath = args[1]
-		ext := filepath.Ext(dstPath)
-		if ext != schema.ACIExtension {
-			errStr := fmt.Sprintf("Extension must be %s (given %s)", schema.ACIExtension, ext)
-			err := errors.New(errStr)
-			return err
-		}
 	}
 
 	if flagDebug {
@@ -104,68 +106,82 @@ func RunOCI2ACI(args []string, flagDebug bool, flagName string) error {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 
-	manifestName = flagName
-	_, err := types.NewACName(manifestName)
+	c, err := NewConverter(WithName(flagName))
 	if err != nil {
 		return err
 	}
+	return c.Convert(srcPath, dstPath)
+}
 
-	if bValidate := validateOCIProc(srcPath); bValidate != true {
-		logrus.Infof("Conversion stop.")
-		return nil
+// Convert the oci bundle in srcPath to an aci image, which is stored in
+// dstPath if given
+func (c *Converter) convertBundle(ctx context.Context, srcPath, dstPath string) error {
+	c.progress(Progress{Phase: PhaseValidate})
+	if err := c.validateOCIProc(srcPath); err != nil {
+		return err
 	}
 
-	dirWork := createWorkDir()
+	dirWork, err := c.createWorkDir()
+	if err != nil {
+		return err
+	}
 	// First, convert layout
-	manifestPath, err := convertLayout(srcPath, dirWork)
+	manifestPath, err := c.convertLayout(ctx, srcPath, dirWork)
 	if err != nil {
-		logrus.Debugf("Conversion from oci to aci layout failed: %v", err)
+		os.RemoveAll(dirWork)
+		return err
+	}
+	if dstPath != "" {
+		c.logger.Debugf("Manifest file converted successfully.")
 	} else {
-		if dstPath != "" {
-			logrus.Debugf("Manifest file converted successfully.")
-		} else {
-			logrus.Debugf("Manifest:%v generated successfully.", manifestPath)
-		}
+		c.logger.Debugf("Manifest:%v generated successfully.", manifestPath)
 	}
 	// Second, build image
-	imgPath, err := buildACI(dirWork)
+	imgPath, imageID, err := c.buildACI(ctx, dirWork)
 	if err != nil {
-		logrus.Debugf("Generate aci image failed:%v", err)
+		os.RemoveAll(dirWork)
+		os.Remove(imgPath)
+		return err
+	}
+	if dstPath != "" {
+		c.logger.Debugf("ACI image converted successfully.")
 	} else {
-		if dstPath != "" {
-			logrus.Debugf("ACI image converted successfully.")
-		} else {
-			logrus.Debugf("Image:%v generated successfully.", imgPath)
-		}
+		c.logger.Debugf("Image:%v generated successfully.", imgPath)
 	}
+	c.logger.Debugf("Image ID: %s", imageID)
 	// Save aci image to the path user specified
 	if dstPath != "" {
-		if err = run(exec.Command("mv", imgPath, dstPath)); err != nil {
-			logrus.Debugf("Store aci image failed:%v", err)
-		} else {
-			logrus.Debugf("Image:%v generated successfully", dstPath)
+		defer os.RemoveAll(dirWork)
+		c.progress(Progress{Phase: PhaseStore})
+		if err := run(exec.CommandContext(ctx, "mv", imgPath, dstPath)); err != nil {
+			os.Remove(imgPath)
+			return &BuildError{Op: "store image", Path: dstPath, Err: err}
 		}
-		run(exec.Command("mv", manifestPath, "./"))
-		run(exec.Command("rm", "-rf", dirWork))
+		c.logger.Debugf("Image:%v generated successfully", dstPath)
 	}
 
+	c.progress(Progress{Phase: PhaseDone, ImageID: imageID})
 	return nil
 }
 
 // Create work directory for the conversion output
-func createWorkDir() string {
-	idir, err := ioutil.TempDir("", "oci2aci")
+func (c *Converter) createWorkDir() (string, error) {
+	idir, err := ioutil.TempDir(c.tmpDir, "oci2aci")
 	if err != nil {
-		return ""
+		return "", &BuildError{Op: "create work directory", Path: c.tmpDir, Err: err}
 	}
 	rootfs := filepath.Join(idir, "rootfs")
-	os.MkdirAll(rootfs, 0755)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		os.RemoveAll(idir)
+		return "", &BuildError{Op: "create work directory", Path: rootfs, Err: err}
+	}
 
 	data := []byte{}
 	if err := ioutil.WriteFile(filepath.Join(idir, "manifest"), data, 0644); err != nil {
-		return ""
+		os.RemoveAll(idir)
+		return "", &BuildError{Op: "create work directory", Path: idir, Err: err}
 	}
-	return idir
+	return idir, nil
 }
 
 // The structure of appc manifest:
@@ -191,6 +207,9 @@ func createWorkDir() string {
 //	6.2 authors
 //	6.3 homepage
 //	6.4 documentation
+//	6.5 oci-version
+//	6.6 os/linux/apparmor-profile
+//	6.7 hostname
 // 7. dependencies
 //	7.1 imageName
 //	7.2 imageID
@@ -198,75 +217,176 @@ func createWorkDir() string {
 //	7.4 size
 // 8. pathWhitelist
 
-func genManifest(path string) *schema.ImageManifest {
+// Generate the aci manifest from the oci bundle in path by running the
+// mappers of the converter, and the files the manifest needs in the aci
+// rootfs, e.g. hook wrappers
+func (c *Converter) genManifest(path string) (*schema.ImageManifest, []aciFile, error) {
+	rootfs, err := c.bundleRootfs(path)
+	if err != nil {
+		return nil, nil, &BundleError{Path: path, Err: err}
+	}
+
 	// Get runtime.json and config.json
 	runtimePath := path + "/runtime.json"
 	configPath := path + "/config.json"
 
 	runtime, err := ioutil.ReadFile(runtimePath)
 	if err != nil {
-		logrus.Debugf("Open file runtime.json failed: %v", err)
-		return nil
+		return nil, nil, &BundleError{Path: path, Err: err}
 	}
 
 	config, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		logrus.Debugf("Open file config.json failed: %v", err)
-		return nil
+		return nil, nil, &BundleError{Path: path, Err: err}
 	}
 
 	var spec specs.LinuxSpec
 	err = json.Unmarshal(config, &spec)
 	if err != nil {
-		logrus.Debugf("Unmarshal config.json failed: %v", err)
-		return nil
+		return nil, nil, newSpecError(ConfigFile, err)
 	}
 
 	var runSpec specs.LinuxRuntimeSpec
 	err = json.Unmarshal(runtime, &runSpec)
 	if err != nil {
-		logrus.Debugf("Unmarshal runtime.json failed: %v", err)
-		return nil
+		return nil, nil, newSpecError(RuntimeFile, err)
+	}
+	imgConfig, err := c.loadImageConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	source := path
+	if c.source != "" {
+		source = c.source
+	}
+	b := &Bundle{
+		Path:        path,
+		Rootfs:      rootfs,
+		ImageConfig: imgConfig,
+		Strict:      c.strict,
+		Logger:      c.logger,
+		c:           c,
+		report:      &Report{Source: source, Platform: c.platform},
 	}
+	// The rootfs is the one of the aci
+	b.Mapped(ConfigFile, "/root/path", "rootfs")
+
 	// Begin to convert runtime.json/config.json to manifest
 	m := new(schema.ImageManifest)
+	m.App = new(types.App)
+	for _, nm := range c.mappers {
+		if err := nm.mapper.Map(b, spec, runSpec, m); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	// 1. Assemble "acKind" field
+	// Labels and annotations given by the user win over generated ones
+	if err := c.applyMetadata(m); err != nil {
+		return nil, nil, err
+	}
+	// 8. pathWhitelist, the rootfs as the filter of the converter keeps it,
+	// unless a mapper of the registry set it
+	if c.whitelist && m.PathWhitelist == nil {
+		if m.PathWhitelist, err = c.pathWhitelist(rootfs, b.files); err != nil {
+			return nil, nil, &BundleError{Path: path, Err: err}
+		}
+	}
+
+	if err := b.reportUnhandled(ConfigFile, config); err != nil {
+		return nil, nil, err
+	}
+	if err := b.reportUnhandled(RuntimeFile, runtime); err != nil {
+		return nil, nil, err
+	}
+	var lost []FieldReport
+	if c.strict {
+		lost = c.checkLoss(b.report)
+	}
+	if c.reportFn != nil {
+		c.reportFn(b.report)
+	}
+	if len(lost) != 0 {
+		return nil, nil, &UnsupportedFieldError{Fields: lost}
+	}
+
+	return m, b.files, nil
+}
+
+// 1. Assemble "acKind" field
+func mapACKind(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
 	m.ACKind = schema.ImageManifestKind
+	return nil
+}
 
-	// 2. Assemble "acVersion" field
+// 2. Assemble "acVersion" field
+func mapACVersion(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
 	m.ACVersion = schema.AppContainerVersion
+	return nil
+}
 
-	// 3. Assemble "name" field
-	m.Name = types.ACIdentifier(manifestName)
+// 3. Assemble "name" field
+func mapName(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	m.Name = types.ACIdentifier(b.c.name)
+	return nil
+}
 
-	// 4. Assemble "labels" field
+// 4. Assemble "labels" field
+func mapLabels(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
 	// 4.1 "version"
-	label := new(types.Label)
-	label.Name = types.ACIdentifier("version")
-	label.Value = spec.Version
-	m.Labels = append(m.Labels, *label)
+	// spec.Version is the version of the oci spec, not of the app, so
+	// the label is only set if the input tells the app version
+	imgConfig := b.ImageConfig
+	if version := b.c.genVersion(imgConfig); version != "" {
+		label := new(types.Label)
+		label.Name = types.ACIdentifier("version")
+		label.Value = version
+		m.Labels = append(m.Labels, *label)
+	}
 	// 4.2 "os"
-	label = new(types.Label)
+	// config.json has no arch variant, take it from the image config
+	variant := ""
+	if imgConfig != nil && imgConfig.Architecture == spec.Platform.Arch {
+		variant = imgConfig.Variant
+	}
+	aciOS, aciArch, err := ociToACIPlatform(spec.Platform.OS, spec.Platform.Arch, variant)
+	if err != nil {
+		field := "/platform/arch"
+		if !knownOS(spec.Platform.OS) {
+			field = "/platform/os"
+		}
+		return &UnsupportedFieldError{Fields: []FieldReport{{
+			File:   ConfigFile,
+			Field:  field,
+			Status: FieldDropped,
+			Note:   err.Error() + ", appc has no label for it",
+		}}}
+	}
+	b.Mapped(ConfigFile, "/platform/os", "labels/os")
+	b.Mapped(ConfigFile, "/platform/arch", "labels/arch")
+	label := new(types.Label)
 	label.Name = types.ACIdentifier("os")
-	label.Value = spec.Platform.OS
+	label.Value = aciOS
 	m.Labels = append(m.Labels, *label)
 	// 4.3 "arch"
 	label = new(types.Label)
 	label.Name = types.ACIdentifier("arch")
-	label.Value = spec.Platform.Arch
+	label.Value = aciArch
 	m.Labels = append(m.Labels, *label)
+	return nil
+}
 
-	// 5. Assemble "app" field
-	app := new(types.App)
-	// 5.1 "exec"
-	app.Exec = spec.Process.Args
+// 5.1 "exec"
+func mapExec(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	app := m.App
+	// Copy the args, spec is shared by all mappers
+	app.Exec = append(types.Exec(nil), spec.Process.Args...)
 
 	prefixDir := ""
 	//var exeStr string
-	if app.Exec == nil {
+	if len(app.Exec) == 0 {
 		app.Exec = append(app.Exec, "/bin/sh")
 	} else {
+		arg0 := app.Exec[0]
 		if !filepath.IsAbs(app.Exec[0]) {
 			if spec.Process.Cwd == "" {
 				prefixDir = "/"
@@ -281,52 +401,96 @@ func genManifest(path string) *schema.ImageManifest {
 		if len(res) <= 2 {
 			app.Exec[0] = "/bin" + app.Exec[0]
 		}
+		if app.Exec[0] == arg0 {
+			b.Mapped(ConfigFile, "/process/args", "app/exec")
+		} else {
+			b.Approximated(ConfigFile, "/process/args", "app/exec", fmt.Sprintf("appc needs an absolute path, %q is run as %q", arg0, app.Exec[0]))
+		}
 	}
+	return nil
+}
+
+// 5.2 "user"
+func mapUser(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	m.App.User = fmt.Sprintf("%d", spec.Process.User.UID)
+	b.Mapped(ConfigFile, "/process/user/uid", "app/user")
+	return nil
+}
 
-	// 5.2 "user"
-	app.User = fmt.Sprintf("%d", spec.Process.User.UID)
-	// 5.3 "group"
+// 5.3 "group"
+func mapGroup(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	app := m.App
 	app.Group = fmt.Sprintf("%d", spec.Process.User.GID)
 	for index := range spec.Process.User.AdditionalGids {
 		app.SupplementaryGIDs = append(app.SupplementaryGIDs, int(spec.Process.User.AdditionalGids[index]))
 	}
-	// 5.4 "eventHandlers"
-	event := new(types.EventHandler)
-	event.Name = "pre-start"
-	for index := range runSpec.Hooks.Prestart {
-		event.Exec = append(event.Exec, runSpec.Hooks.Prestart[index].Path)
-		event.Exec = append(event.Exec, runSpec.Hooks.Prestart[index].Args...)
-		event.Exec = append(event.Exec, runSpec.Hooks.Prestart[index].Env...)
-	}
-	if len(event.Exec) == 0 {
-		event.Exec = append(event.Exec, "/bin/echo")
-		event.Exec = append(event.Exec, "-n")
-	}
-	app.EventHandlers = append(app.EventHandlers, *event)
-	event = new(types.EventHandler)
-	event.Name = "post-stop"
-	for index := range runSpec.Hooks.Poststop {
-		event.Exec = append(event.Exec, runSpec.Hooks.Poststop[index].Path)
-		event.Exec = append(event.Exec, runSpec.Hooks.Poststop[index].Args...)
-		event.Exec = append(event.Exec, runSpec.Hooks.Poststop[index].Env...)
-	}
-	if len(event.Exec) == 0 {
-		event.Exec = append(event.Exec, "/bin/echo")
-		event.Exec = append(event.Exec, "-n")
-	}
-	app.EventHandlers = append(app.EventHandlers, *event)
-	// 5.5 "workingDirectory"
-	app.WorkingDirectory = spec.Process.Cwd
-	// 5.6 "environment"
+	b.Mapped(ConfigFile, "/process/user/gid", "app/group")
+	b.Mapped(ConfigFile, "/process/user/additionalGids", "app/supplementaryGIDs")
+	return nil
+}
+
+// 5.4 "eventHandlers", the poststart hooks wrap the exec
+func mapEventHandlers(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	app := m.App
+	for _, h := range []struct {
+		name  string
+		hooks []specs.Hook
+	}{{"pre-start", runSpec.Hooks.Prestart}, {"post-stop", runSpec.Hooks.Poststop}} {
+		event, err := b.c.genEventHandler(h.name, h.hooks, b.Rootfs, &b.files)
+		if err != nil {
+			return err
+		}
+		if event != nil {
+			app.EventHandlers = append(app.EventHandlers, *event)
+		}
+	}
+	exec, err := b.c.genPoststartExec(app.Exec, runSpec.Hooks.Poststart, b.Rootfs, &b.files)
+	if err != nil {
+		return err
+	}
+	app.Exec = exec
+
+	for _, h := range []struct {
+		field string
+		hooks []specs.Hook
+	}{{"/hooks/prestart", runSpec.Hooks.Prestart}, {"/hooks/poststop", runSpec.Hooks.Poststop}} {
+		switch {
+		case len(h.hooks) == 1 && len(h.hooks[0].Env) == 0:
+			b.Mapped(RuntimeFile, h.field, "app/eventHandlers")
+		case len(h.hooks) != 0:
+			b.Approximated(RuntimeFile, h.field, "app/eventHandlers", "the hooks are run by a wrapper script in "+HooksDir)
+		}
+	}
+	if len(runSpec.Hooks.Poststart) != 0 {
+		b.Approximated(RuntimeFile, "/hooks/poststart", "app/exec", "appc has no post-start event, the hooks are run in the background by a wrapper of the exec")
+	}
+	return nil
+}
+
+// 5.5 "workingDirectory"
+func mapWorkingDirectory(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	m.App.WorkingDirectory = spec.Process.Cwd
+	b.Mapped(ConfigFile, "/process/cwd", "app/workingDirectory")
+	return nil
+}
+
+// 5.6 "environment"
+func mapEnvironment(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	app := m.App
 	env := new(types.EnvironmentVariable)
 	for index := range spec.Process.Env {
-		s := strings.Split(spec.Process.Env[index], "=")
+		s := strings.SplitN(spec.Process.Env[index], "=", 2)
 		env.Name = s[0]
 		env.Value = s[1]
 		app.Environment = append(app.Environment, *env)
 	}
+	b.Mapped(ConfigFile, "/process/env", "app/environment")
+	return nil
+}
 
-	// 5.7 "mountPoints"
+// 5.7 "mountPoints"
+func mapMountPoints(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	app := m.App
 	for index := range spec.Mounts {
 		mount := new(types.MountPoint)
 		mount.Name = types.ACName(spec.Mounts[index].Name)
@@ -334,10 +498,23 @@ func genManifest(path string) *schema.ImageManifest {
 		mount.ReadOnly = false
 		app.MountPoints = append(app.MountPoints, *mount)
 	}
+	b.Mapped(ConfigFile, "/mounts", "app/mountPoints")
+	return nil
+}
 
-	// 5.8 "ports"
+// 5.8 "ports"
+func mapPorts(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	ports, err := b.c.genPorts(b.ImageConfig)
+	if err != nil {
+		return err
+	}
+	m.App.Ports = ports
+	return nil
+}
 
-	// 5.9 "isolators"
+// 5.9 "isolators"
+func mapIsolators(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	app := m.App
 	if runSpec.Linux.Resources != nil {
 		if *runSpec.Linux.Resources.CPU.Quota != 0 {
 			cpuLimt := new(ResourceCPU)
@@ -350,6 +527,7 @@ func genManifest(path string) *schema.ImageManifest {
 			isolator.ValueRaw = &valueRaw
 
 			app.Isolators = append(app.Isolators, *isolator)
+			b.Approximated(RuntimeFile, "/linux/resources/cpu/quota", "app/isolators/resource/cpu", "the cfs quota is used as millicores limit")
 		}
 		if *runSpec.Linux.Resources.Memory.Limit != 0 {
 			memLimt := new(ResourceMem)
@@ -362,6 +540,11 @@ func genManifest(path string) *schema.ImageManifest {
 			isolator.ValueRaw = &valueRaw
 
 			app.Isolators = append(app.Isolators, *isolator)
+			if *runSpec.Linux.Resources.Memory.Limit%(1024*1024*1024) == 0 {
+				b.Mapped(RuntimeFile, "/linux/resources/memory/limit", "app/isolators/resource/memory")
+			} else {
+				b.Approximated(RuntimeFile, "/linux/resources/memory/limit", "app/isolators/resource/memory", "the limit is rounded down to GiB")
+			}
 		}
 	}
 
@@ -377,11 +560,40 @@ func genManifest(path string) *schema.ImageManifest {
 		isolator.ValueRaw = &valueRaw
 
 		app.Isolators = append(app.Isolators, *isolator)
+		b.Mapped(ConfigFile, "/linux/capabilities", "app/isolators/"+types.LinuxCapabilitiesRetainSetName)
 	}
 
-	m.App = app
+	if runSpec.Linux.SelinuxProcessLabel != "" {
+		isolator, err := genSELinuxIsolator(runSpec.Linux.SelinuxProcessLabel)
+		if err != nil {
+			b.Logger.Warnf("Drop selinuxProcessLabel: %v", err)
+			b.Dropped(RuntimeFile, "/linux/selinuxProcessLabel", err.Error())
+		} else {
+			app.Isolators = append(app.Isolators, *isolator)
+			b.Mapped(RuntimeFile, "/linux/selinuxProcessLabel", "app/isolators/"+SELinuxContextName)
+		}
+	}
+
+	if spec.Root.Readonly {
+		readOnly := new(IsolatorReadOnlyRootfs)
+		readOnly.ReadOnly = true
+
+		isolator := new(types.Isolator)
+		isolator.Name = types.ACIdentifier(ReadOnlyRootfsName)
+		bytes, _ := json.Marshal(readOnly)
 
-	// 6. "annotations"
+		valueRaw := json.RawMessage(bytes)
+		isolator.ValueRaw = &valueRaw
+
+		app.Isolators = append(app.Isolators, *isolator)
+		b.Logger.Warnf("root.readonly is set but aci runtimes may not enforce a read-only rootfs, only the %q isolator is emitted", ReadOnlyRootfsName)
+		b.Approximated(ConfigFile, "/root/readonly", "app/isolators/"+ReadOnlyRootfsName, "the isolator is not part of appc, runtimes may ignore it")
+	}
+	return nil
+}
+
+// 6. "annotations"
+func mapAnnotations(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
 	anno := new(types.Annotation)
 	anno.Name = types.ACIdentifier("created")
 	anno.Value = time.Now().Format(time.RFC3339)
@@ -392,22 +604,87 @@ func genManifest(path string) *schema.ImageManifest {
 	anno.Name = types.ACIdentifier("homepage")
 	anno.Value = "https://github.com/huawei-openlab/oci2aci"
 	m.Annotations = append(m.Annotations, *anno)
-	// 7. "dependencies"
+	// 6.5 "oci-version"
+	if spec.Version != "" {
+		anno.Name = types.ACIdentifier(OCIVersionName)
+		anno.Value = spec.Version
+		m.Annotations = append(m.Annotations, *anno)
+		b.Mapped(ConfigFile, "/version", "annotations/"+OCIVersionName)
+	}
+	// 6.6 "os/linux/apparmor-profile"
+	if runSpec.Linux.ApparmorProfile != "" {
+		anno.Name = types.ACIdentifier(AppArmorProfileName)
+		anno.Value = runSpec.Linux.ApparmorProfile
+		m.Annotations = append(m.Annotations, *anno)
+		b.Approximated(RuntimeFile, "/linux/apparmorProfile", "annotations/"+AppArmorProfileName, "appc has no apparmor isolator, the profile is only recorded")
+	}
+	// 6.7 "hostname"
+	if spec.Hostname != "" {
+		anno.Name = types.ACIdentifier(HostnameName)
+		anno.Value = spec.Hostname
+		m.Annotations = append(m.Annotations, *anno)
+		b.Approximated(ConfigFile, "/hostname", "annotations/"+HostnameName, "the hostname is set by the pod, it is only recorded")
+	}
+	return nil
+}
 
-	// 8. "pathWhitelist"
+// 7. "dependencies" and 8. "pathWhitelist" are not generated from the
+// bundle, a custom mapper may set them
 
-	return m
+// Convert selinuxProcessLabel of runtime.json, which is formatted as
+// "user:role:type:level", to the appc selinux context isolator
+func genSELinuxIsolator(label string) (*types.Isolator, error) {
+	// The level itself may contain ':', e.g. "s0:c1,c2"
+	s := strings.SplitN(label, ":", 4)
+	if len(s) != 4 {
+		return nil, fmt.Errorf("selinux label %q can not be represented as appc isolator, expected user:role:type:level", label)
+	}
+	for _, field := range s {
+		if field == "" {
+			return nil, fmt.Errorf("selinux label %q can not be represented as appc isolator, empty field", label)
+		}
+	}
+
+	selinuxCtx := new(IsolatorSELinuxContext)
+	selinuxCtx.User = s[0]
+	selinuxCtx.Role = s[1]
+	selinuxCtx.Type = s[2]
+	selinuxCtx.Level = s[3]
+
+	isolator := new(types.Isolator)
+	isolator.Name = types.ACIdentifier(SELinuxContextName)
+	bytes, err := json.Marshal(selinuxCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	valueRaw := json.RawMessage(bytes)
+	isolator.ValueRaw = &valueRaw
+
+	return isolator, nil
 }
 
 // Convert OCI layout to ACI layout
-func convertLayout(srcPath, dstPath string) (string, error) {
-	src, _ := filepath.Abs(srcPath)
-	src += "/rootfs"
-	if err := run(exec.Command("cp", "-rf", src, dstPath)); err != nil {
-		return "", err
+func (c *Converter) convertLayout(ctx context.Context, srcPath, dstPath string) (string, error) {
+	src, err := c.bundleRootfs(srcPath)
+	if err != nil {
+		return "", &BundleError{Path: srcPath, Err: err}
+	}
+	// The content of the rootfs is copied whatever its name, with the
+	// modes, setuid bits included, the owners and the hard links
+	c.progress(Progress{Phase: PhaseCopy})
+	if err := run(exec.CommandContext(ctx, "cp", "-rfp", "--preserve=links", src+"/.", filepath.Join(dstPath, "rootfs"))); err != nil {
+		return "", &BuildError{Op: "copy rootfs", Path: src, Err: err}
 	}
 
-	m := genManifest(srcPath)
+	c.progress(Progress{Phase: PhaseManifest})
+	m, files, err := c.genManifest(srcPath)
+	if err != nil {
+		return "", err
+	}
+	if err := writeACIFiles(filepath.Join(dstPath, "rootfs"), files); err != nil {
+		return "", err
+	}
 
 	bytes, err := json.MarshalIndent(m, "", "\t")
 	if err != nil {
@@ -416,6 +693,8 @@ func convertLayout(srcPath, dstPath string) (string, error) {
 
 	manifestPath := dstPath + "/manifest"
 
-	ioutil.WriteFile(manifestPath, bytes, 0644)
+	if err := ioutil.WriteFile(manifestPath, bytes, 0644); err != nil {
+		return "", &BuildError{Op: "write manifest", Path: manifestPath, Err: err}
+	}
 	return manifestPath, nil
 }
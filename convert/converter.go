@@ -0,0 +1,426 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// DefaultName is the name of the aci manifest if none is given
+const DefaultName = "oci"
+
+// Converter converts oci bundles and OCI image layouts to acis. It holds
+// all the settings of a conversion, so several Converters, or several
+// conversions of one Converter, can run in parallel in one process.
+type Converter struct {
+	// Name of the aci manifest and version label from the image reference
+	name    string
+	version string
+	// In strict mode conversion fails instead of dropping or approximating
+	// fields which cannot be represented in the aci manifest, except the
+	// ones the policy allows
+	strict bool
+	policy *Policy
+	// Ports as "name:proto:port[-end][:socketActivated]"
+	ports []string
+	// OCI or Docker image config the bundle was unpacked from
+	imageConfigPath string
+	// Labels and annotations as "name=value", and the overlay file
+	labels      []string
+	annotations []string
+	metadata    *Metadata
+	// Platforms of an image layout to convert, as "os/arch[/variant]"
+	// separated by ','
+	platforms string
+	// Format the aci is compressed with, and how many files are read and
+	// blocks compressed at once
+	compression Compression
+	jobs        int
+	// Where the original bundle files are kept in the aci
+	stash Stash
+	// What to do with the files of the bundle besides the bundle ones
+	extraFiles ExtraFiles
+	// Whether root.path may name a directory outside of the bundle
+	externalRootfs bool
+	// Files of the rootfs which go to the aci
+	filter pathFilter
+	// Whether the manifest lists the paths of the aci rootfs
+	whitelist bool
+	// Whether the special bits of the rootfs are cleared
+	stripSetID         bool
+	stripWorldWritable bool
+	// Whether the files of the rootfs with the same content are stored once
+	dedup bool
+	// Directory of the work directories, the system default if empty
+	tmpDir string
+	logger *logrus.Logger
+	// Receiver of progress events, and os/arch of the aci being converted
+	// from an image layout
+	progressFn ProgressFunc
+	platform   string
+	// Receiver of the reports, and the source they name if it is not the
+	// bundle converted
+	reportFn ReportFunc
+	source   string
+	// Mappers filling the aci manifest, in the order they run
+	mappers []namedMapper
+}
+
+// Option configures a Converter
+type Option func(*Converter) error
+
+// NewConverter returns a Converter configured by the given options
+func NewConverter(opts ...Option) (*Converter, error) {
+	c := &Converter{
+		name:        DefaultName,
+		logger:      logrus.StandardLogger(),
+		mappers:     defaultMappers(),
+		extraFiles:  ExtraFilesWarn,
+		compression: CompressionNone,
+		jobs:        runtime.NumCPU(),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// WithName sets the name of the aci manifest
+func WithName(name string) Option {
+	return func(c *Converter) error {
+		if _, err := types.NewACName(name); err != nil {
+			return err
+		}
+		c.name = name
+		return nil
+	}
+}
+
+// WithImage sets the name of the aci manifest and the version label from an
+// image reference such as "example.com/team/app:1.4.2"
+func WithImage(ref string) Option {
+	return func(c *Converter) error {
+		name, version, err := parseImageRef(ref)
+		if err != nil {
+			return err
+		}
+		c.name = name
+		c.version = version
+		return nil
+	}
+}
+
+// WithStrict makes conversion fail instead of dropping or approximating
+// fields which cannot be represented in the aci manifest. The error lists
+// all of them, except the ones the policy allows.
+func WithStrict(strict bool) Option {
+	return func(c *Converter) error {
+		c.strict = strict
+		return nil
+	}
+}
+
+// WithPorts adds ports given as "name:proto:port[-end][:socketActivated]"
+func WithPorts(ports ...string) Option {
+	return func(c *Converter) error {
+		for _, p := range ports {
+			if _, err := parsePortFlag(p); err != nil {
+				return err
+			}
+		}
+		c.ports = append(c.ports, ports...)
+		return nil
+	}
+}
+
+// WithImageConfig sets the OCI or Docker image config the bundle was
+// unpacked from, it supplies ports, version and arch variant
+func WithImageConfig(path string) Option {
+	return func(c *Converter) error {
+		c.imageConfigPath = path
+		return nil
+	}
+}
+
+// WithLabels sets labels given as "name=value", an empty value removes one
+func WithLabels(labels ...string) Option {
+	return func(c *Converter) error {
+		for _, f := range labels {
+			if err := setLabelFlag(&schema.ImageManifest{}, f); err != nil {
+				return err
+			}
+		}
+		c.labels = append(c.labels, labels...)
+		return nil
+	}
+}
+
+// WithAnnotations sets annotations given as "name=value", an empty value
+// removes one
+func WithAnnotations(annotations ...string) Option {
+	return func(c *Converter) error {
+		for _, f := range annotations {
+			if err := setAnnotationFlag(&schema.ImageManifest{}, f); err != nil {
+				return err
+			}
+		}
+		c.annotations = append(c.annotations, annotations...)
+		return nil
+	}
+}
+
+// WithMetadataFile sets the YAML or JSON overlay file of labels and
+// annotations
+func WithMetadataFile(path string) Option {
+	return func(c *Converter) error {
+		if path == "" {
+			return nil
+		}
+		meta, err := LoadMetadata(path)
+		if err != nil {
+			return err
+		}
+		c.metadata = meta
+		return nil
+	}
+}
+
+// WithPlatforms selects the platforms of an image layout to convert, given
+// as "os/arch[/variant]" separated by ','
+func WithPlatforms(platforms string) Option {
+	return func(c *Converter) error {
+		if _, err := parsePlatformFilter(platforms); err != nil {
+			return err
+		}
+		c.platforms = platforms
+		return nil
+	}
+}
+
+// WithCompression enables gzip compression of the aci
+func WithCompression(compress bool) Option {
+	return func(c *Converter) error {
+		c.compression = CompressionNone
+		if compress {
+			c.compression = CompressionGzip
+		}
+		return nil
+	}
+}
+
+// WithExternalRootfs allows root.path of config.json to name a directory
+// outside of the bundle
+func WithExternalRootfs(allow bool) Option {
+	return func(c *Converter) error {
+		c.externalRootfs = allow
+		return nil
+	}
+}
+
+// WithTempDir sets the directory in which work directories are created
+func WithTempDir(dir string) Option {
+	return func(c *Converter) error {
+		c.tmpDir = dir
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the conversion
+func WithLogger(logger *logrus.Logger) Option {
+	return func(c *Converter) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// Manifest converts the oci bundle in ociPath to an aci layout and returns
+// the path of its manifest
+func (c *Converter) Manifest(ociPath string) (string, error) {
+	return c.ManifestContext(context.Background(), ociPath)
+}
+
+// ManifestContext is Manifest which stops when ctx is done. The aci layout
+// is removed then, and ctx.Err() is returned.
+func (c *Converter) ManifestContext(ctx context.Context, ociPath string) (string, error) {
+	c.progress(Progress{Phase: PhaseValidate})
+	if err := c.validateOCIProc(ociPath); err != nil {
+		return "", err
+	}
+
+	dirWork, err := c.createWorkDir()
+	if err != nil {
+		return "", err
+	}
+	// convert layout
+	aciManifestPath, err := c.convertLayout(ctx, ociPath, dirWork)
+	if err != nil {
+		os.RemoveAll(dirWork)
+		return "", contextErr(ctx, err)
+	}
+	c.progress(Progress{Phase: PhaseDone})
+	return aciManifestPath, err
+}
+
+// Image converts the oci bundle in ociPath to an aci image and returns its
+// path
+func (c *Converter) Image(ociPath string) (string, error) {
+	return c.ImageContext(context.Background(), ociPath)
+}
+
+// ImageContext is Image which stops when ctx is done. The aci layout and
+// image are removed then, and ctx.Err() is returned.
+func (c *Converter) ImageContext(ctx context.Context, ociPath string) (string, error) {
+	c.progress(Progress{Phase: PhaseValidate})
+	if err := c.validateOCIProc(ociPath); err != nil {
+		return "", err
+	}
+
+	dirWork, err := c.createWorkDir()
+	if err != nil {
+		return "", err
+	}
+	// First, convert layout
+	_, err = c.convertLayout(ctx, ociPath, dirWork)
+	if err != nil {
+		os.RemoveAll(dirWork)
+		return "", contextErr(ctx, err)
+	}
+
+	// Second, build image
+	aciImgPath, imageID, err := c.buildACI(ctx, dirWork)
+	if err != nil {
+		os.RemoveAll(dirWork)
+		os.Remove(aciImgPath)
+		return "", contextErr(ctx, err)
+	}
+	c.logger.Debugf("Image ID: %s", imageID)
+	c.progress(Progress{Phase: PhaseDone, ImageID: imageID})
+	return aciImgPath, nil
+}
+
+// GenerateManifest returns the aci manifest of the oci bundle in ociPath.
+// Nothing is written to disk.
+func (c *Converter) GenerateManifest(ctx context.Context, ociPath string) (*schema.ImageManifest, error) {
+	c.progress(Progress{Phase: PhaseValidate})
+	if err := c.validateOCIProc(ociPath); err != nil {
+		return nil, err
+	}
+	c.progress(Progress{Phase: PhaseManifest})
+	m, _, err := c.genManifest(ociPath)
+	if err != nil {
+		return nil, err
+	}
+	c.progress(Progress{Phase: PhaseDone})
+	return m, nil
+}
+
+// WriteImage converts the oci bundle in ociPath to an aci image streamed to
+// w, and returns its manifest. The rootfs is read in place, so nothing is
+// written to disk. The manifest is checked against the rootfs before the
+// image is written, as Convert checks the aci. w is not closed, and holds
+// an incomplete image if an error is returned.
+func (c *Converter) WriteImage(ctx context.Context, ociPath string, w io.Writer) (*schema.ImageManifest, error) {
+	c.progress(Progress{Phase: PhaseValidate})
+	if err := c.validateOCIProc(ociPath); err != nil {
+		return nil, err
+	}
+	c.progress(Progress{Phase: PhaseManifest})
+	m, files, err := c.genManifest(ociPath)
+	if err != nil {
+		return nil, err
+	}
+	rootfs, err := c.bundleRootfs(ociPath)
+	if err != nil {
+		return nil, &BundleError{Path: ociPath, Err: err}
+	}
+	if err := c.verifyManifest(ctx, m, rootfs, files); err != nil {
+		if _, ok := err.(*ValidationError); ok {
+			err = &BuildError{Op: "verify image", Path: ociPath, Err: err}
+		}
+		return nil, contextErr(ctx, err)
+	}
+	imageID, err := c.writeACI(ctx, w, *m, rootfs, files, ociPath)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	c.logger.Debugf("Image ID: %s", imageID)
+	c.progress(Progress{Phase: PhaseDone, ImageID: imageID})
+	return m, nil
+}
+
+// ErrDestination is wrapped by the errors of a conversion given a
+// destination of the wrong kind for its source
+var ErrDestination = errors.New("invalid destination")
+
+// Convert converts the oci bundle in srcPath to an aci image stored in
+// dstPath, if given. An OCI image layout is converted to one aci per
+// platform in the directory dstPath instead, and an aci is converted back
+// to an oci bundle in the directory dstPath.
+func (c *Converter) Convert(srcPath, dstPath string) error {
+	return c.ConvertContext(context.Background(), srcPath, dstPath)
+}
+
+// ConvertContext is Convert which stops when ctx is done. Temporary files
+// and incomplete acis are removed then, and ctx.Err() is returned.
+func (c *Converter) ConvertContext(ctx context.Context, srcPath, dstPath string) error {
+	var err error
+	if filepath.Ext(srcPath) == schema.ACIExtension {
+		if dstPath == "" {
+			return fmt.Errorf("%w: bundle directory of %s must be given", ErrDestination, srcPath)
+		}
+		return c.ConvertToBundle(ctx, srcPath, dstPath)
+	}
+	if isImageLayout(srcPath) {
+		err = c.convertImageLayout(ctx, srcPath, dstPath)
+		return contextErr(ctx, err)
+	}
+	if dstPath != "" {
+		if ext := filepath.Ext(dstPath); ext != schema.ACIExtension {
+			return fmt.Errorf("%w: extension must be %s (given %s)", ErrDestination, schema.ACIExtension, ext)
+		}
+	}
+	err = c.convertBundle(ctx, srcPath, dstPath)
+	return contextErr(ctx, err)
+}
+
+// A conversion failing because ctx is done reports ctx.Err() rather than
+// the error of the step it was interrupted in
+func contextErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Validate checks the oci bundle, or the aci if path has the .aci
+// extension, without converting it. An invalid bundle is reported by a
+// BundleError or a SpecError, an invalid aci by a ValidationError.
+func (c *Converter) Validate(ctx context.Context, path string) error {
+	if filepath.Ext(path) == schema.ACIExtension {
+		return c.verifyImage(ctx, path)
+	}
+	return c.validateOCIProc(path)
+}
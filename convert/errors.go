@@ -0,0 +1,138 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BundleError reports an invalid oci bundle
+type BundleError struct {
+	Path string
+	Err  error
+}
+
+func (e *BundleError) Error() string {
+	return fmt.Sprintf("invalid oci bundle %s: %v", e.Path, e.Err)
+}
+
+func (e *BundleError) Unwrap() error {
+	return e.Err
+}
+
+// SpecError reports a config.json or runtime.json which can't be parsed.
+// Field is the JSON pointer of the offending value and Offset its byte
+// offset in the file, if known.
+type SpecError struct {
+	File   string
+	Field  string
+	Offset int64
+	Err    error
+}
+
+func (e *SpecError) Error() string {
+	switch {
+	case e.Field != "":
+		return fmt.Sprintf("parse %s failed at %s: %v", e.File, e.Field, e.Err)
+	case e.Offset != 0:
+		return fmt.Sprintf("parse %s failed at offset %d: %v", e.File, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("parse %s failed: %v", e.File, e.Err)
+}
+
+func (e *SpecError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is an invalid value of a bundle file or of an aci manifest
+type FieldError struct {
+	// ConfigFile, RuntimeFile or the aci manifest, and the JSON pointer of
+	// the value
+	File    string `json:"file"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	switch {
+	case e.File == "":
+		return e.Message
+	case e.Field == "":
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", e.File, e.Field, e.Message)
+}
+
+// ValidationError lists the invalid values of config.json and runtime.json,
+// it is wrapped in a BundleError, or the problems of a built aci, wrapped in
+// a BuildError
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var lines []string
+	for _, f := range e.Errors {
+		lines = append(lines, "\n  "+f.String())
+	}
+	return fmt.Sprintf("%d invalid fields:%s", len(e.Errors), strings.Join(lines, ""))
+}
+
+// UnsupportedFieldError reports the fields which are dropped or
+// approximated in the aci and the policy doesn't allow to lose, it is
+// returned in strict mode only
+type UnsupportedFieldError struct {
+	Fields []FieldReport
+}
+
+func (e *UnsupportedFieldError) Error() string {
+	var lines []string
+	for _, f := range e.Fields {
+		lines = append(lines, fmt.Sprintf("\n  %s %s %s: %s", f.Status, f.File, f.Field, f.Note))
+	}
+	return fmt.Sprintf("%d unsupported fields:%s", len(e.Fields), strings.Join(lines, ""))
+}
+
+// BuildError reports an I/O error while building the aci
+type BuildError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("build: %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap an error of json.Unmarshal of a spec file, with the location of the
+// offending value if the decoder tells it
+func newSpecError(file string, err error) error {
+	serr := &SpecError{File: file, Err: err}
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		serr.Offset = e.Offset
+		if e.Field != "" {
+			serr.Field = "/" + strings.Replace(e.Field, ".", "/", -1)
+		}
+	case *json.SyntaxError:
+		serr.Offset = e.Offset
+	}
+	return serr
+}
@@ -0,0 +1,133 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/opencontainers/specs"
+)
+
+// ExtraFiles tells what to do with the files of a bundle besides
+// config.json, runtime.json and the rootfs, e.g. a README or signatures
+type ExtraFiles string
+
+const (
+	// The bundle is invalid
+	ExtraFilesReject ExtraFiles = "reject"
+	// The files are left out of the aci
+	ExtraFilesIgnore ExtraFiles = "ignore"
+	// The files are left out of the aci with a warning, the default
+	ExtraFilesWarn ExtraFiles = "warn"
+	// The files are added to the aci rootfs in ExtraFilesDir
+	ExtraFilesEmbed ExtraFiles = "embed"
+)
+
+// Directory of the aci rootfs holding the extra files of the bundle, at
+// their path relative to the bundle
+const ExtraFilesDir = HooksDir + "/bundle"
+
+// WithExtraFiles sets what to do with the files of the bundle besides
+// config.json, runtime.json and the rootfs
+func WithExtraFiles(extra ExtraFiles) Option {
+	return func(c *Converter) error {
+		switch extra {
+		case ExtraFilesReject, ExtraFilesIgnore, ExtraFilesWarn, ExtraFilesEmbed:
+		default:
+			return fmt.Errorf("invalid extra files policy %q, expected %q, %q, %q or %q", extra,
+				ExtraFilesReject, ExtraFilesIgnore, ExtraFilesWarn, ExtraFilesEmbed)
+		}
+		c.extraFiles = extra
+		return nil
+	}
+}
+
+// Apply the extra files policy to the extra files of the bundle in path
+func (c *Converter) checkExtraFiles(path string, extra []string) error {
+	if len(extra) == 0 {
+		return nil
+	}
+	switch c.extraFiles {
+	case ExtraFilesReject:
+		return fmt.Errorf("unrecognized file path in bundle: %q", extra[0])
+	case ExtraFilesWarn:
+		c.logger.Warnf("%s: files besides the bundle ones are not converted: %s", path, strings.Join(extra, ", "))
+	case ExtraFilesIgnore:
+		c.logger.Debugf("%s: ignore the files %s", path, strings.Join(extra, ", "))
+	case ExtraFilesEmbed:
+		c.logger.Debugf("%s: embed the files %s in %s", path, strings.Join(extra, ", "), ExtraFilesDir)
+	}
+	return nil
+}
+
+// Add the extra files of the bundle to the aci rootfs if the converter
+// embeds them. Only regular files are embedded.
+func mapExtraFiles(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	if b.c.extraFiles != ExtraFilesEmbed {
+		return nil
+	}
+	extra, err := validateBundle(b.Path, b.Rootfs)
+	if err != nil {
+		return &BundleError{Path: b.Path, Err: err}
+	}
+	for _, rpath := range extra {
+		fpath := filepath.Join(b.Path, rpath)
+		fi, err := os.Lstat(fpath)
+		if err != nil {
+			return &BundleError{Path: b.Path, Err: err}
+		}
+		if !fi.Mode().IsRegular() {
+			b.Logger.Warnf("Skip %s of the bundle, it is not a regular file", rpath)
+			continue
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return &BundleError{Path: b.Path, Err: err}
+		}
+		b.AddFile(filepath.Join(ExtraFilesDir, rpath), fi.Mode().Perm(), data)
+	}
+	return nil
+}
+
+// Move the extra files embedded in the aci rootfs back to the bundle in
+// dstDir
+func restoreExtraFiles(rootfs, dstDir string) error {
+	dir := filepath.Join(rootfs, ExtraFilesDir)
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	err := filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rpath, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstDir, rpath)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Rename(fpath, target)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,173 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Which files of the rootfs go to the aci. Patterns are the ones of
+// path.Match: with a '/', they match the path inside the rootfs and the
+// files below it, e.g. "/usr/share/doc", else the base name of any file,
+// e.g. "*.pyc".
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+// WithInclude keeps only the files of the rootfs matching one of the
+// patterns, and the directories holding them. Files oci2aci adds to the
+// rootfs are always kept.
+func WithInclude(patterns ...string) Option {
+	return func(c *Converter) error {
+		if err := checkPatterns(patterns); err != nil {
+			return err
+		}
+		c.filter.include = append(c.filter.include, patterns...)
+		return nil
+	}
+}
+
+// WithExclude leaves the files of the rootfs matching one of the patterns
+// out of the aci, even if they are included
+func WithExclude(patterns ...string) Option {
+	return func(c *Converter) error {
+		if err := checkPatterns(patterns); err != nil {
+			return err
+		}
+		c.filter.exclude = append(c.filter.exclude, patterns...)
+		return nil
+	}
+}
+
+// WithPathWhitelist sets the pathWhitelist of the aci manifest to the paths
+// of the aci rootfs, so that images depending on it only get them. A
+// pathWhitelist set by a mapper is kept as is.
+func WithPathWhitelist(enable bool) Option {
+	return func(c *Converter) error {
+		c.whitelist = enable
+		return nil
+	}
+}
+
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if p == "" {
+			return fmt.Errorf("empty path pattern")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// Tell whether the file at p inside the rootfs goes to the aci
+func (f pathFilter) keep(p string, dir bool) bool {
+	for _, pattern := range f.exclude {
+		if matchPath(pattern, p) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matchPath(pattern, p) || dir && matchParent(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell whether the pattern matches the path or one of its parents
+func matchPath(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		for ; p != "/" && p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, path.Base(p)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	pattern = path.Clean("/" + pattern)
+	for ; p != "/" && p != "."; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell whether the directory dir may hold paths the pattern matches
+func matchParent(pattern, dir string) bool {
+	if !strings.Contains(pattern, "/") {
+		return true
+	}
+	pelems := strings.Split(strings.Trim(path.Clean("/"+pattern), "/"), "/")
+	delems := strings.Split(strings.Trim(dir, "/"), "/")
+	if len(delems) >= len(pelems) {
+		return false
+	}
+	for i, e := range delems {
+		if ok, _ := path.Match(pelems[i], e); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the paths of the aci rootfs, the files of rootfs the filter keeps
+// and the generated files with their directories, as the pathWhitelist of
+// the manifest
+func (c *Converter) pathWhitelist(rootfs string, files []aciFile) ([]string, error) {
+	seen := map[string]bool{}
+	for _, f := range files {
+		for p := path.Clean("/" + f.Path); p != "/"; p = path.Dir(p) {
+			seen[p] = true
+		}
+	}
+	err := filepath.Walk(rootfs, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, fpath)
+		if err != nil || rel == "." {
+			return err
+		}
+		// Sockets are not archived
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		p := "/" + filepath.ToSlash(rel)
+		if c.filter.keep(p, info.IsDir()) {
+			seen[p] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var whitelist []string
+	for p := range seen {
+		whitelist = append(whitelist, p)
+	}
+	sort.Strings(whitelist)
+	return whitelist, nil
+}
@@ -0,0 +1,134 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// WithDedup stores the regular files of the aci rootfs with the same
+// content, mode and owner once: the duplicates are hard links to the first
+// one. The files then share their content in the container, writing to one
+// changes the others, and the modification time of the first one.
+func WithDedup(dedup bool) Option {
+	return func(c *Converter) error {
+		c.dedup = dedup
+		return nil
+	}
+}
+
+// A file on its filesystem
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// What the duplicates of a regular file have in common besides the content
+type contentKey struct {
+	size int64
+	mode int64
+	uid  int
+	gid  int
+}
+
+// A regular file written to the image, its digest is computed once another
+// file of the same size, mode and owner shows up
+type dupCandidate struct {
+	path   string
+	name   string
+	digest []byte
+}
+
+// Finds the entries of the rootfs which are hard links to a previous entry,
+// by inode, and by content if the converter deduplicates
+type linker struct {
+	dedup    bool
+	inodes   map[fileID]string
+	contents map[contentKey][]*dupCandidate
+	// Hard links of the rootfs, and duplicates turned into hard links with
+	// the bytes they would take
+	links int
+	dups  int
+	saved int64
+}
+
+func newLinker(dedup bool) *linker {
+	return &linker{
+		dedup:    dedup,
+		inodes:   map[fileID]string{},
+		contents: map[contentKey][]*dupCandidate{},
+	}
+}
+
+// Return the name of the entry the entry hdr of the file at fpath is a hard
+// link to, or "" if it is written in full. digest is the one of the file if
+// it is known. Only the entries the image holds may be passed, so links
+// always point to an entry before them.
+func (l *linker) link(fpath string, info os.FileInfo, hdr *tar.Header, digest []byte) (string, error) {
+	if hdr.Typeflag == tar.TypeDir {
+		return "", nil
+	}
+	if id, nlink, ok := fileIdentity(info); ok && nlink > 1 {
+		if name, ok := l.inodes[id]; ok {
+			l.links++
+			return name, nil
+		}
+		l.inodes[id] = hdr.Name
+	}
+	if !l.dedup || hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+		return "", nil
+	}
+
+	key := contentKey{size: hdr.Size, mode: hdr.Mode, uid: hdr.Uid, gid: hdr.Gid}
+	cand := &dupCandidate{path: fpath, name: hdr.Name, digest: digest}
+	if others := l.contents[key]; len(others) != 0 {
+		var err error
+		if cand.digest == nil {
+			if cand.digest, err = fileDigest(fpath); err != nil {
+				return "", err
+			}
+		}
+		for _, o := range others {
+			if o.digest == nil {
+				if o.digest, err = fileDigest(o.path); err != nil {
+					return "", err
+				}
+			}
+			if bytes.Equal(o.digest, cand.digest) {
+				l.dups++
+				l.saved += hdr.Size
+				return o.name, nil
+			}
+		}
+	}
+	l.contents[key] = append(l.contents[key], cand)
+	return "", nil
+}
+
+func fileDigest(fpath string) ([]byte, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
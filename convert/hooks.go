@@ -0,0 +1,136 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/opencontainers/specs"
+)
+
+const (
+	// Directory inside the aci rootfs holding the generated hook wrappers
+	HooksDir = "/.oci2aci"
+	// Shell used to run the generated hook wrappers
+	HooksShell = "/bin/sh"
+)
+
+// Names of the variables the hook wrappers can set, the ones of the shell
+var hookEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Convert the hooks of one lifecycle event to an appc event handler.
+// A single hook without env is executed directly, otherwise a wrapper
+// script running all hooks in order is added to the files of the aci
+// rootfs. nil is returned if there is nothing to run.
+func (c *Converter) genEventHandler(name string, hooks []specs.Hook, rootfs string, files *[]aciFile) (*types.EventHandler, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	event := new(types.EventHandler)
+	event.Name = name
+	if len(hooks) == 1 && len(hooks[0].Env) == 0 {
+		event.Exec = append(event.Exec, hooks[0].Path)
+		event.Exec = append(event.Exec, hooks[0].Args...)
+		return event, nil
+	}
+
+	// pre-start hooks abort the start of the container on failure, the
+	// others only log the error and go on with the remaining hooks
+	script := c.genHooksScript(hooks, name == "pre-start")
+	path, err := c.addHooksScript(rootfs, name, script, files)
+	if err != nil {
+		return nil, err
+	}
+	event.Exec = append(event.Exec, path)
+	return event, nil
+}
+
+// appc has no post-start event, so the poststart hooks are started in the
+// background by a wrapper which then execs the original app
+func (c *Converter) genPoststartExec(exec types.Exec, hooks []specs.Hook, rootfs string, files *[]aciFile) (types.Exec, error) {
+	if len(hooks) == 0 {
+		return exec, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("(\n")
+	buf.Write(c.genHooksScript(hooks, false))
+	buf.WriteString(") &\n")
+	buf.WriteString("exec \"$@\"\n")
+
+	path, err := c.addHooksScript(rootfs, "post-start", buf.Bytes(), files)
+	if err != nil {
+		return nil, err
+	}
+	var res types.Exec
+	res = append(res, path)
+	res = append(res, exec...)
+	return res, nil
+}
+
+// Generate the commands running the given hooks in order. The env of a
+// hook is passed as variable assignments of its command line.
+func (c *Converter) genHooksScript(hooks []specs.Hook, abort bool) []byte {
+	var buf bytes.Buffer
+	for _, hook := range hooks {
+		var words []string
+		for _, env := range hook.Env {
+			s := strings.SplitN(env, "=", 2)
+			// The name is not quoted, so it must not be shell syntax
+			if len(s) != 2 || !hookEnvName.MatchString(s[0]) {
+				c.logger.Warnf("Drop invalid env %q of hook %s", env, hook.Path)
+				continue
+			}
+			words = append(words, s[0]+"="+shellQuote(s[1]))
+		}
+		words = append(words, shellQuote(hook.Path))
+		for _, arg := range hook.Args {
+			words = append(words, shellQuote(arg))
+		}
+		cmd := strings.Join(words, " ")
+		if abort {
+			fmt.Fprintf(&buf, "%s || exit $?\n", cmd)
+		} else {
+			fmt.Fprintf(&buf, "%s || echo %s >&2\n", cmd, shellQuote("hook "+hook.Path+" failed"))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Add a hook wrapper to the files of the aci rootfs, return its path
+// inside the image. rootfs must have the shell running it.
+func (c *Converter) addHooksScript(rootfs string, name string, script []byte, files *[]aciFile) (string, error) {
+	if _, err := os.Lstat(filepath.Join(rootfs, HooksShell)); err != nil {
+		return "", &BundleError{Path: rootfs, Err: fmt.Errorf("%s not found, the %s hook wrapper can't run", HooksShell, name)}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#!" + HooksShell + "\n")
+	buf.WriteString("# Generated by oci2aci from the hooks of runtime.json\n")
+	buf.Write(script)
+	path := filepath.Join(HooksDir, name)
+	*files = append(*files, aciFile{Path: path, Mode: 0755, Data: buf.Bytes()})
+	return path, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
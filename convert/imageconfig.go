@@ -0,0 +1,55 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// ImageConfig holds the fields of an OCI or Docker image config, which
+// the oci bundle was unpacked from, that are used during the conversion.
+type ImageConfig struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	// Variant of the architecture, e.g. "v7" for arm
+	Variant string `json:"variant"`
+	Config  struct {
+		User       string   `json:"User"`
+		Env        []string `json:"Env"`
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+		WorkingDir string   `json:"WorkingDir"`
+		// ExposedPorts is a set of "port[-end][/proto]" keys
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		// Labels holds the image annotations, e.g. org.opencontainers.image.*
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// Load the image config of the converter, nil is returned if there is none.
+func (c *Converter) loadImageConfig() (*ImageConfig, error) {
+	if c.imageConfigPath == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.imageConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	imgConfig := new(ImageConfig)
+	if err := json.Unmarshal(data, imgConfig); err != nil {
+		return nil, &SpecError{File: c.imageConfigPath, Err: err}
+	}
+	return imgConfig, nil
+}
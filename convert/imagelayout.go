@@ -0,0 +1,599 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/opencontainers/specs"
+)
+
+const (
+	// Files marking an OCI image layout
+	ImageLayoutFile = "oci-layout"
+	ImageIndexFile  = "index.json"
+	// Index of the acis converted from an image layout
+	ACIIndexFile = "aci-index.json"
+
+	mediaTypeImageIndex  = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	whiteoutPrefix       = ".wh."
+	whiteoutOpaqueMarker = ".wh..wh..opq"
+)
+
+// Descriptor of a blob in the image layout
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// An OCI image index or a Docker manifest list
+type imageIndex struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+// An OCI or Docker image manifest
+type imageManifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+// ACIIndex lists the acis converted from the platforms of an image layout
+type ACIIndex struct {
+	Name   string          `json:"name"`
+	Images []ACIIndexEntry `json:"images"`
+}
+
+type ACIIndexEntry struct {
+	// File name of the aci, relative to the index
+	File string `json:"file"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// Digest of the image manifest the aci was converted from
+	Source string `json:"source"`
+}
+
+// Report whether path is an OCI image layout rather than an oci bundle
+func isImageLayout(path string) bool {
+	if _, err := os.Stat(filepath.Join(path, ImageLayoutFile)); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(path, ImageIndexFile))
+	return err == nil
+}
+
+// Convert every platform of an image layout, or the ones selected by the
+// converter, to an aci in dstDir, and write an index of the acis.
+func (c *Converter) convertImageLayout(ctx context.Context, srcPath, dstDir string) error {
+	if dstDir == "" {
+		dstDir = "."
+	}
+	if filepath.Ext(dstDir) == schema.ACIExtension {
+		return fmt.Errorf("%w: output of an image layout must be a directory (given %s)", ErrDestination, dstDir)
+	}
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+
+	filter, err := parsePlatformFilter(c.platforms)
+	if err != nil {
+		return err
+	}
+
+	var index imageIndex
+	if err := readJSON(filepath.Join(srcPath, ImageIndexFile), &index); err != nil {
+		return err
+	}
+	manifests, err := resolveManifests(srcPath, index.Manifests)
+	if err != nil {
+		return err
+	}
+
+	aciIndex := ACIIndex{Name: c.name}
+	seen := map[string]string{}
+	for _, desc := range manifests {
+		manifestPath, err := blobPath(srcPath, desc.Digest)
+		if err != nil {
+			return err
+		}
+		var m imageManifest
+		if err := readJSON(manifestPath, &m); err != nil {
+			return err
+		}
+		configPath, err := blobPath(srcPath, m.Config.Digest)
+		if err != nil {
+			return err
+		}
+		var imgConfig ImageConfig
+		if err := readJSON(configPath, &imgConfig); err != nil {
+			return err
+		}
+		plat := platform{imgConfig.OS, imgConfig.Architecture, imgConfig.Variant}
+		if desc.Platform != nil {
+			plat = *desc.Platform
+		}
+		aciOS, aciArch, err := ociToACIPlatform(plat.OS, plat.Architecture, plat.Variant)
+		if err != nil {
+			return &UnsupportedFieldError{Fields: []FieldReport{{
+				File:   configPath,
+				Field:  "/architecture",
+				Status: FieldDropped,
+				Note:   fmt.Sprintf("manifest %s: %v, appc has no label for it", desc.Digest, err),
+			}}}
+		}
+		key := aciOS + "/" + aciArch
+		if filter != nil && !filter[key] {
+			c.logger.Debugf("Skip platform %s of manifest %s", key, desc.Digest)
+			continue
+		}
+		if other, ok := seen[key]; ok {
+			return &BundleError{Path: srcPath, Err: fmt.Errorf("manifests %s and %s are both for platform %s", other, desc.Digest, key)}
+		}
+		seen[key] = desc.Digest
+
+		file := fmt.Sprintf("%s-%s-%s.aci", path.Base(c.name), aciOS, aciArch)
+		c.logger.Debugf("Convert platform %s of manifest %s to %s", key, desc.Digest, file)
+		// The progress events of the aci carry its platform
+		cc := *c
+		cc.platform = key
+		if err := cc.convertImageManifest(ctx, srcPath, m, imgConfig, plat, configPath, filepath.Join(dstDir, file)); err != nil {
+			return fmt.Errorf("platform %s: %w", key, err)
+		}
+		aciIndex.Images = append(aciIndex.Images, ACIIndexEntry{
+			File:   file,
+			OS:     aciOS,
+			Arch:   aciArch,
+			Source: desc.Digest,
+		})
+	}
+	if len(aciIndex.Images) == 0 {
+		return fmt.Errorf("no platform of %s matches %q", srcPath, c.platforms)
+	}
+
+	bytes, err := json.MarshalIndent(aciIndex, "", "\t")
+	if err != nil {
+		return err
+	}
+	indexPath := filepath.Join(dstDir, ACIIndexFile)
+	if err := ioutil.WriteFile(indexPath, bytes, 0644); err != nil {
+		return err
+	}
+	c.logger.Debugf("Index:%v generated successfully", indexPath)
+	return nil
+}
+
+// Unpack one image manifest to a temporary oci bundle and convert it
+func (c *Converter) convertImageManifest(ctx context.Context, srcPath string, m imageManifest, imgConfig ImageConfig, plat platform, configPath string, dstPath string) error {
+	bundle, err := ioutil.TempDir(c.tmpDir, "oci2aci-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundle)
+
+	rootfs := filepath.Join(bundle, RootfsDir)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+	var unpacked Progress
+	unpacked.Phase = PhaseUnpack
+	for _, layer := range m.Layers {
+		layerPath, err := blobPath(srcPath, layer.Digest)
+		if err != nil {
+			return err
+		}
+		if err := c.unpackLayer(ctx, layerPath, rootfs, &unpacked); err != nil {
+			return fmt.Errorf("unpack layer %s failed: %w", layer.Digest, err)
+		}
+	}
+
+	spec, err := genSpec(imgConfig, plat, rootfs)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(bundle, ConfigFile), spec); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(bundle, RuntimeFile), new(specs.LinuxRuntimeSpec)); err != nil {
+		return err
+	}
+
+	// Ports and version of the image config are used for the manifest
+	cc := *c
+	cc.imageConfigPath = configPath
+	cc.source = srcPath
+	return cc.convertBundle(ctx, bundle, dstPath)
+}
+
+// Follow nested indexes down to the image manifests
+func resolveManifests(srcPath string, descs []descriptor) ([]descriptor, error) {
+	var res []descriptor
+	for _, desc := range descs {
+		if desc.MediaType != mediaTypeImageIndex && desc.MediaType != mediaTypeDockerList {
+			res = append(res, desc)
+			continue
+		}
+		indexPath, err := blobPath(srcPath, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var index imageIndex
+		if err := readJSON(indexPath, &index); err != nil {
+			return nil, err
+		}
+		nested, err := resolveManifests(srcPath, index.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, nested...)
+	}
+	return res, nil
+}
+
+// Parse the platform filter to a set of appc "os/arch"
+func parsePlatformFilter(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	filter := map[string]bool{}
+	for _, p := range strings.Split(s, ",") {
+		fields := strings.SplitN(strings.TrimSpace(p), "/", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", p)
+		}
+		variant := ""
+		if len(fields) == 3 {
+			variant = fields[2]
+		}
+		aciOS, aciArch, err := ociToACIPlatform(fields[0], fields[1], variant)
+		if err != nil {
+			return nil, err
+		}
+		filter[aciOS+"/"+aciArch] = true
+	}
+	return filter, nil
+}
+
+// Generate config.json of the bundle from the image config
+func genSpec(imgConfig ImageConfig, plat platform, rootfs string) (*specs.LinuxSpec, error) {
+	spec := new(specs.LinuxSpec)
+	spec.Version = specs.Version
+	spec.Platform.OS = plat.OS
+	spec.Platform.Arch = plat.Architecture
+	spec.Root.Path = RootfsDir
+
+	spec.Process.Args = append(spec.Process.Args, imgConfig.Config.Entrypoint...)
+	spec.Process.Args = append(spec.Process.Args, imgConfig.Config.Cmd...)
+	spec.Process.Env = imgConfig.Config.Env
+	spec.Process.Cwd = imgConfig.Config.WorkingDir
+
+	if imgConfig.Config.User != "" {
+		s := strings.SplitN(imgConfig.Config.User, ":", 2)
+		passwd, err := secureJoin(rootfs, "etc/passwd", true)
+		if err != nil {
+			return nil, err
+		}
+		uid, gid, err := lookupID(passwd, s[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid user %q: %v", imgConfig.Config.User, err)
+		}
+		if len(s) == 2 {
+			group, err := secureJoin(rootfs, "etc/group", true)
+			if err != nil {
+				return nil, err
+			}
+			gid, _, err = lookupID(group, s[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid group %q: %v", imgConfig.Config.User, err)
+			}
+		}
+		spec.Process.User.UID = uid
+		spec.Process.User.GID = gid
+	}
+	return spec, nil
+}
+
+// Look up a numeric id, or a name in the passwd or group file of the
+// rootfs. The third field of the entry, and the fourth one for passwd
+// (which is the primary group), are returned.
+func lookupID(file, name string) (uint32, uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), uint32(id), nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid := id
+		if len(fields) > 3 {
+			if gid, err = strconv.ParseUint(fields[3], 10, 32); err != nil {
+				return 0, 0, err
+			}
+		}
+		return uint32(id), uint32(gid), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("%s not found in %s", name, file)
+}
+
+// Apply a layer tarball, gzipped or not, to the rootfs. The entries are
+// added to the files and bytes unpacked so far in p.
+func (c *Converter) unpackLayer(ctx context.Context, layerPath, rootfs string, p *Progress) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Paths the layer extracted, and their parents. Whiteouts only hide the
+	// files of the lower layers.
+	written := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Keep every entry inside the rootfs
+		name := path.Clean("/" + hdr.Name)
+		if escapesRoot(hdr.Name) {
+			c.logger.Warnf("Entry %s of layer %s escapes the rootfs, it is extracted at %s", hdr.Name, layerPath, name)
+		}
+		target, err := secureJoin(rootfs, name, false)
+		if err != nil {
+			return err
+		}
+		dir, base := filepath.Split(target)
+
+		if base == whiteoutOpaqueMarker {
+			if err := clearOpaqueDir(filepath.Clean(dir), written); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := c.extractEntry(tr, hdr, rootfs, name, p); err != nil {
+			return err
+		}
+		for w := target; len(w) > len(rootfs) && !written[w]; w = filepath.Dir(w) {
+			written[w] = true
+		}
+	}
+}
+
+// Remove the files of dir the layer didn't extract, for an opaque whiteout
+// of the layer. The directories the layer extracted are cleared of the
+// files of the lower layers too.
+func clearOpaqueDir(dir string, written map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		switch {
+		case !written[p]:
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		case e.IsDir():
+			if err := clearOpaqueDir(p, written); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Magic of the xz format
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+
+// Return a reader of the tarball in r, decompressed if it is gzipped, or
+// compressed with xz, as the xz command does
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	if magic, err := br.Peek(len(xzMagic)); err == nil && bytes.Equal(magic, xzMagic) {
+		// aci.NewXzReader exits if xz is missing
+		if _, err := exec.LookPath("xz"); err != nil {
+			return nil, fmt.Errorf("xz compressed image needs the xz command: %v", err)
+		}
+		return aci.NewXzReader(br)
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// Create the tar entry hdr, whose content is read from r, at name inside
+// the rootfs. It replaces whatever the rootfs had at its path, except a
+// directory which is merged. Symlinks of the rootfs are resolved inside
+// it, so that no entry is written out of it.
+func (c *Converter) extractEntry(r io.Reader, hdr *tar.Header, rootfs, name string, p *Progress) error {
+	target, err := secureJoin(rootfs, name, false)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(out, r)
+		out.Close()
+		p.Bytes += n
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if escapesRoot(hdr.Linkname) {
+			c.logger.Warnf("Hard link %s to %s escapes the rootfs, it links to %s", name, hdr.Linkname, path.Clean("/"+hdr.Linkname))
+		}
+		linkTarget, err := secureJoin(rootfs, hdr.Linkname, false)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(linkTarget, target); err != nil {
+			return err
+		}
+		// The link shares the mode of its target, which chown clears the
+		// setuid and setgid bits of
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		mode = fi.Mode()
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// Device nodes need privileges, mknod(1) reports why it fails
+		kind := map[byte]string{tar.TypeChar: "c", tar.TypeBlock: "b", tar.TypeFifo: "p"}[hdr.Typeflag]
+		args := []string{"-m", fmt.Sprintf("%o", mode.Perm()), target, kind}
+		if hdr.Typeflag != tar.TypeFifo {
+			args = append(args, strconv.FormatInt(hdr.Devmajor, 10), strconv.FormatInt(hdr.Devminor, 10))
+		}
+		if err := exec.Command("mknod", args...).Run(); err != nil {
+			c.logger.Warnf("Skip device %s: %v", name, err)
+			return nil
+		}
+	default:
+		c.logger.Debugf("Skip %s of unsupported type %q", name, hdr.Typeflag)
+		return nil
+	}
+
+	// Ownership can only be kept when running as root
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	// Keep setuid, setgid and sticky bits dropped by umask, or cleared by
+	// chown
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeLink:
+		// chmod would follow a hard link to a symlink
+		if mode&os.ModeSymlink == 0 {
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	}
+	p.Files++
+	c.progress(*p)
+	return nil
+}
+
+// Digests are "algorithm:hex", anything else could point out of the layout
+var validDigest = regexp.MustCompile(`^[a-z0-9]+:[a-f0-9]+$`)
+
+func blobPath(layout, digest string) (string, error) {
+	if !validDigest.MatchString(digest) {
+		return "", &BundleError{Path: layout, Err: fmt.Errorf("invalid digest %q", digest)}
+	}
+	return filepath.Join(layout, "blobs", strings.Replace(digest, ":", "/", 1)), nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &SpecError{File: path, Err: err}
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}
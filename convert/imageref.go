@@ -0,0 +1,67 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// Image annotation carrying the version of the packaged software, used
+// for the "version" label when the image reference has no tag
+const VersionAnnotation = "org.opencontainers.image.version"
+
+// Same grammar as docker tags
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// Split an image reference such as "example.com/team/app:1.4.2" into the
+// aci name and the version label. A digest is dropped as it doesn't match
+// the aci image ID anyway, an empty version is returned if there's no tag.
+func parseImageRef(ref string) (string, string, error) {
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	version := ""
+	// A ':' before the last '/' belongs to the registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		version = name[i+1:]
+		name = name[:i]
+		if !validTag.MatchString(version) {
+			return "", "", fmt.Errorf("invalid tag %q in image reference %q", version, ref)
+		}
+	}
+	// ':' is not allowed in an ACIdentifier, "localhost:5000/app" is
+	// named "localhost-5000/app"
+	name = strings.Replace(name, ":", "-", -1)
+	if _, err := types.NewACIdentifier(name); err != nil {
+		return "", "", fmt.Errorf("invalid name %q in image reference %q: %v", name, ref, err)
+	}
+	return name, version, nil
+}
+
+// Get the version label, the tag of the image reference wins over the
+// version annotation of the image config
+func (c *Converter) genVersion(imgConfig *ImageConfig) string {
+	if c.version != "" {
+		return c.version
+	}
+	if imgConfig != nil {
+		return imgConfig.Config.Labels[VersionAnnotation]
+	}
+	return ""
+}
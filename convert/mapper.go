@@ -0,0 +1,159 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/appc/spec/schema"
+	"github.com/opencontainers/specs"
+)
+
+// Names of the built-in mappers, in the order they run. Each one fills a
+// section of the aci manifest.
+const (
+	MapperACKind           = "acKind"
+	MapperACVersion        = "acVersion"
+	MapperName             = "name"
+	MapperLabels           = "labels"
+	MapperExec             = "app/exec"
+	MapperUser             = "app/user"
+	MapperGroup            = "app/group"
+	MapperEventHandlers    = "app/eventHandlers"
+	MapperWorkingDirectory = "app/workingDirectory"
+	MapperEnvironment      = "app/environment"
+	MapperMountPoints      = "app/mountPoints"
+	MapperPorts            = "app/ports"
+	MapperIsolators        = "app/isolators"
+	MapperAnnotations      = "annotations"
+	MapperExtraFiles       = "extraFiles"
+	MapperStash            = "stash"
+)
+
+// Mapper translates part of an oci bundle to the aci manifest. spec and
+// runSpec are the config.json and runtime.json of the bundle, m is the
+// manifest built by the mappers run so far.
+type Mapper interface {
+	Map(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error
+}
+
+// MapperFunc is a function used as Mapper
+type MapperFunc func(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error
+
+// Map calls f
+func (f MapperFunc) Map(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	return f(b, spec, runSpec, m)
+}
+
+// Bundle is the oci bundle being converted, as the mappers see it
+type Bundle struct {
+	// Directory of the bundle and of its rootfs
+	Path   string
+	Rootfs string
+	// Image config the bundle was unpacked from, nil if not known
+	ImageConfig *ImageConfig
+	// Whether fields which can't be represented must fail the conversion
+	Strict bool
+	Logger *logrus.Logger
+
+	c      *Converter
+	files  []aciFile
+	report *Report
+}
+
+// AddFile adds a file to the aci rootfs, path is its path inside the image.
+// A file of the bundle rootfs at the same path is replaced.
+func (b *Bundle) AddFile(path string, mode os.FileMode, data []byte) {
+	b.files = append(b.files, aciFile{Path: path, Mode: mode, Data: data})
+}
+
+type namedMapper struct {
+	name   string
+	mapper Mapper
+}
+
+// The built-in mappers, the manifest is filled section by section
+func defaultMappers() []namedMapper {
+	return []namedMapper{
+		{MapperACKind, MapperFunc(mapACKind)},
+		{MapperACVersion, MapperFunc(mapACVersion)},
+		{MapperName, MapperFunc(mapName)},
+		{MapperLabels, MapperFunc(mapLabels)},
+		{MapperExec, MapperFunc(mapExec)},
+		{MapperUser, MapperFunc(mapUser)},
+		{MapperGroup, MapperFunc(mapGroup)},
+		{MapperEventHandlers, MapperFunc(mapEventHandlers)},
+		{MapperWorkingDirectory, MapperFunc(mapWorkingDirectory)},
+		{MapperEnvironment, MapperFunc(mapEnvironment)},
+		{MapperMountPoints, MapperFunc(mapMountPoints)},
+		{MapperPorts, MapperFunc(mapPorts)},
+		{MapperIsolators, MapperFunc(mapIsolators)},
+		{MapperAnnotations, MapperFunc(mapAnnotations)},
+		{MapperExtraFiles, MapperFunc(mapExtraFiles)},
+		{MapperStash, MapperFunc(mapStash)},
+	}
+}
+
+// WithMapper replaces the mapper of the given name, or adds it after all
+// others if there is none
+func WithMapper(name string, m Mapper) Option {
+	return func(c *Converter) error {
+		if m == nil {
+			return fmt.Errorf("mapper %s is nil", name)
+		}
+		// The registry may be shared with a copy of the converter
+		mappers := append([]namedMapper(nil), c.mappers...)
+		for i := range mappers {
+			if mappers[i].name == name {
+				mappers[i].mapper = m
+				c.mappers = mappers
+				return nil
+			}
+		}
+		c.mappers = append(mappers, namedMapper{name, m})
+		return nil
+	}
+}
+
+// WithoutMapper disables the mapper of the given name
+func WithoutMapper(name string) Option {
+	return func(c *Converter) error {
+		var mappers []namedMapper
+		found := false
+		for _, nm := range c.mappers {
+			if nm.name == name {
+				found = true
+				continue
+			}
+			mappers = append(mappers, nm)
+		}
+		if !found {
+			return fmt.Errorf("no mapper %s", name)
+		}
+		c.mappers = mappers
+		return nil
+	}
+}
+
+// Mappers returns the names of the mappers of the converter, in the order
+// they run
+func (c *Converter) Mappers() []string {
+	var names []string
+	for _, nm := range c.mappers {
+		names = append(names, nm.name)
+	}
+	return names
+}
@@ -0,0 +1,177 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"gopkg.in/yaml.v2"
+)
+
+// Metadata is the overlay file format for labels and annotations, in YAML
+// or JSON. An empty or null value removes the label or annotation.
+type Metadata struct {
+	Labels      map[string]*string `yaml:"labels" json:"labels"`
+	Annotations map[string]*string `yaml:"annotations" json:"annotations"`
+}
+
+// LoadMetadata reads an overlay file and checks the names it sets
+func LoadMetadata(file string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is a subset of YAML, so both are parsed the same way
+	var meta Metadata
+	if err := yaml.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("unmarshal metadata file %s failed: %v", file, err)
+	}
+	if err := meta.apply(&schema.ImageManifest{}); err != nil {
+		return nil, fmt.Errorf("metadata file %s: %v", file, err)
+	}
+	return &meta, nil
+}
+
+// Set the labels and annotations of the overlay file in the manifest
+func (meta *Metadata) apply(m *schema.ImageManifest) error {
+	// Apply in a stable order, so errors are reproducible
+	for _, name := range sortedKeys(meta.Labels) {
+		if err := setLabel(m, name, meta.Labels[name]); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(meta.Annotations) {
+		if err := setAnnotation(m, name, meta.Annotations[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the overlay file and then the labels and annotations of the
+// converter to the manifest, overriding or removing the generated ones
+func (c *Converter) applyMetadata(m *schema.ImageManifest) error {
+	if c.metadata != nil {
+		if err := c.metadata.apply(m); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range c.labels {
+		if err := setLabelFlag(m, f); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.annotations {
+		if err := setAnnotationFlag(m, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set a label given as "name=value" in the manifest
+func setLabelFlag(m *schema.ImageManifest, f string) error {
+	name, value, err := parseNameValue(f)
+	if err != nil {
+		return fmt.Errorf("invalid label: %v", err)
+	}
+	return setLabel(m, name, value)
+}
+
+// Set an annotation given as "name=value" in the manifest
+func setAnnotationFlag(m *schema.ImageManifest, f string) error {
+	name, value, err := parseNameValue(f)
+	if err != nil {
+		return fmt.Errorf("invalid annotation: %v", err)
+	}
+	return setAnnotation(m, name, value)
+}
+
+// Set or, if value is nil or empty, remove a label of the manifest
+func setLabel(m *schema.ImageManifest, name string, value *string) error {
+	acid, err := types.NewACIdentifier(name)
+	if err != nil {
+		return fmt.Errorf("invalid label name %q: %v", name, err)
+	}
+	if *acid == "name" {
+		return fmt.Errorf(`invalid label name "name", set the name of the image instead`)
+	}
+
+	var labels types.Labels
+	found := false
+	for _, label := range m.Labels {
+		if !label.Name.Equals(*acid) {
+			labels = append(labels, label)
+			continue
+		}
+		// Override in place, so the label keeps its position
+		if value != nil && *value != "" {
+			labels = append(labels, types.Label{Name: *acid, Value: *value})
+		}
+		found = true
+	}
+	if !found && value != nil && *value != "" {
+		labels = append(labels, types.Label{Name: *acid, Value: *value})
+	}
+	m.Labels = labels
+	return nil
+}
+
+// Set or, if value is nil or empty, remove an annotation of the manifest
+func setAnnotation(m *schema.ImageManifest, name string, value *string) error {
+	acid, err := types.NewACIdentifier(name)
+	if err != nil {
+		return fmt.Errorf("invalid annotation name %q: %v", name, err)
+	}
+
+	if value != nil && *value != "" {
+		m.Annotations.Set(*acid, *value)
+		return nil
+	}
+	var annos types.Annotations
+	for _, anno := range m.Annotations {
+		if !anno.Name.Equals(*acid) {
+			annos = append(annos, anno)
+		}
+	}
+	m.Annotations = annos
+	return nil
+}
+
+// Parse "name=value", an empty value is returned as nil
+func parseNameValue(s string) (string, *string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", nil, fmt.Errorf("%q is not formatted as name=value", s)
+	}
+	if kv[1] == "" {
+		return kv[0], nil, nil
+	}
+	return kv[0], &kv[1], nil
+}
+
+func sortedKeys(m map[string]*string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
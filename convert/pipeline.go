@@ -0,0 +1,359 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/tarheader"
+	"github.com/appc/spec/schema"
+)
+
+// The building of an aci is a pipeline: the rootfs is walked with the
+// files of each directory stat'ed in parallel, then jobs read the files
+// ahead of the writer, which adds them to the tar in the order of the walk.
+
+// Files up to this size are read ahead, larger ones are read by the writer
+const readAheadSize = 1 << 20
+
+// Modification time of the files oci2aci generates and of the manifest, so
+// that the aci only depends on the bundle
+var buildTime = time.Unix(0, 0)
+
+// A file of the rootfs
+type rootfsEntry struct {
+	path string
+	info os.FileInfo
+}
+
+// Return the files under root, root first, in the order of filepath.Walk.
+// The files of a directory are stat'ed by jobs goroutines.
+func walkRootfs(ctx context.Context, root string, jobs int) ([]rootfsEntry, error) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	entries := []rootfsEntry{{root, info}}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		names, err := readDirNames(dir)
+		if err != nil {
+			return err
+		}
+		infos, err := lstatAll(dir, names, jobs)
+		if err != nil {
+			return err
+		}
+		for i, name := range names {
+			p := filepath.Join(dir, name)
+			entries = append(entries, rootfsEntry{p, infos[i]})
+			if infos[i].IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if info.IsDir() {
+		if err := walk(root); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func lstatAll(dir string, names []string, jobs int) ([]os.FileInfo, error) {
+	infos := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+	if jobs > len(names) {
+		jobs = len(names)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				infos[i], errs[i] = os.Lstat(filepath.Join(dir, names[i]))
+			}
+		}()
+	}
+	for i := range names {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// A file of the rootfs on its way to the image
+type buildEntry struct {
+	rootfsEntry
+	// Header once the callback kept it, nil if the file is left out
+	hdr *tar.Header
+	// Content read ahead, and its digest if the converter deduplicates
+	data   []byte
+	digest []byte
+	err    error
+	// Closed once the entry is read, nil if it is not read ahead
+	ready chan struct{}
+}
+
+// Add the files of the rootfs to the image in order, the files are read by
+// c.jobs goroutines. Only the entries the callback keeps are added, as hard
+// links to a previous one if the linker finds so. done is called for each
+// file once it is added or left out.
+func (c *Converter) addEntries(ctx context.Context, aw aci.ArchiveWriter, entries []rootfsEntry, root string, l *linker, cb aci.TarHeaderWalkFunc, done func(n int64)) error {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+
+	// The window of entries read ahead is bounded, so is the memory
+	pending := make(chan *buildEntry, 4*c.jobs)
+	reads := make(chan *buildEntry)
+	for j := 0; j < c.jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range reads {
+				e.data, e.err = ioutil.ReadFile(e.path)
+				if e.err == nil && l.dedup {
+					sum := sha256.Sum256(e.data)
+					e.digest = sum[:]
+				}
+				close(e.ready)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+		defer close(reads)
+		for _, re := range entries {
+			e := &buildEntry{rootfsEntry: re}
+			e.hdr, e.err = entryHeader(root, re)
+			if e.hdr != nil && !cb(e.hdr) {
+				e.hdr = nil
+			}
+			if e.hdr != nil && re.info.Mode().IsRegular() && re.info.Size() <= readAheadSize {
+				e.ready = make(chan struct{})
+				select {
+				case reads <- e:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case pending <- e:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for e := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if e.ready != nil {
+			<-e.ready
+		}
+		if e.err != nil {
+			return e.err
+		}
+		if err := c.addEntry(aw, e, l); err != nil {
+			return err
+		}
+		var n int64
+		if e.info.Mode().IsRegular() {
+			n = e.info.Size()
+		}
+		done(n)
+	}
+	return nil
+}
+
+// Return the header of a file of the rootfs, named by its path relative to
+// root like aci.BuildWalker does. Only what the rootfs holds is kept, so
+// that the same rootfs gives the same tar.
+func entryHeader(root string, e rootfsEntry) (*tar.Header, error) {
+	relpath, err := filepath.Rel(root, e.path)
+	if err != nil {
+		return nil, err
+	}
+	link := ""
+	switch e.info.Mode() & os.ModeType {
+	case os.ModeSocket:
+		return nil, nil
+	case os.ModeSymlink:
+		if link, err = os.Readlink(e.path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(e.info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = relpath
+	// The inodes are left to the linker, which only sees the entries kept
+	tarheader.Populate(hdr, e.info, map[uint64]string{})
+	// The access and change times differ between copies of the rootfs, and
+	// the user and group names between hosts
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	return hdr, nil
+}
+
+// Add a file of the rootfs to the image, as a hard link if the linker finds
+// it is one
+func (c *Converter) addEntry(aw aci.ArchiveWriter, e *buildEntry, l *linker) error {
+	if e.hdr == nil {
+		return nil
+	}
+	target, err := l.link(e.path, e.info, e.hdr, e.digest)
+	if err != nil {
+		return err
+	}
+	if target != "" {
+		e.hdr.Typeflag = tar.TypeLink
+		e.hdr.Linkname = target
+		e.hdr.Size = 0
+		return aw.AddFile(e.hdr, nil)
+	}
+	if !e.info.Mode().IsRegular() {
+		return aw.AddFile(e.hdr, nil)
+	}
+	if e.ready != nil {
+		return aw.AddFile(e.hdr, bytes.NewReader(e.data))
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return aw.AddFile(e.hdr, f)
+}
+
+// A writer passing what it writes to w, whose sha512 is computed in another
+// goroutine
+type hashWriter struct {
+	w      io.Writer
+	blocks chan []byte
+	sum    chan []byte
+}
+
+func newHashWriter(w io.Writer) *hashWriter {
+	hw := &hashWriter{w: w, blocks: make(chan []byte, 16), sum: make(chan []byte)}
+	go func() {
+		h := sha512.New()
+		for b := range hw.blocks {
+			h.Write(b)
+		}
+		hw.sum <- h.Sum(nil)
+	}()
+	return hw
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	hw.blocks <- append([]byte(nil), p...)
+	return hw.w.Write(p)
+}
+
+// Return the image ID of what was written, once. Nothing is written after.
+func (hw *hashWriter) imageID() string {
+	close(hw.blocks)
+	return fmt.Sprintf("sha512-%x", <-hw.sum)
+}
+
+// An aci.ArchiveWriter which writes the manifest last, like the one of
+// aci.NewImageWriter, but with the build time so that it doesn't change
+// the image
+type imageWriter struct {
+	tw       *tar.Writer
+	manifest schema.ImageManifest
+}
+
+func (iw *imageWriter) AddFile(hdr *tar.Header, r io.Reader) error {
+	if err := iw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r != nil {
+		if _, err := io.Copy(iw.tw, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iw *imageWriter) Close() error {
+	data, err := iw.manifest.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     aci.ManifestFile,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  buildTime,
+		Typeflag: tar.TypeReg,
+		Uname:    "root",
+		Gname:    "root",
+	}
+	if err := iw.AddFile(hdr, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return iw.tw.Close()
+}
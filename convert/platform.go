@@ -0,0 +1,94 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"strings"
+)
+
+// platformMap maps an OCI/Docker os, arch and variant to the appc arch label
+type platformMap struct {
+	OS      string
+	Arch    string
+	Variant string
+	ACIArch string
+}
+
+// The first entry of an appc arch is the one used for the reverse mapping.
+// Only the os and arch labels types.ValidOSArch accepts are mapped to.
+var platformMaps = []platformMap{
+	{"linux", "amd64", "", "amd64"},
+	{"linux", "386", "", "i386"},
+	{"linux", "arm64", "", "aarch64"},
+	{"linux", "arm64", "v8", "aarch64"},
+	{"linux", "arm", "v7", "armv7l"},
+	{"linux", "arm", "", "armv7l"},
+	{"linux", "arm", "v6", "armv6l"},
+	{"freebsd", "amd64", "", "amd64"},
+	{"freebsd", "386", "", "i386"},
+	{"freebsd", "arm", "", "arm"},
+	{"darwin", "amd64", "", "x86_64"},
+	{"darwin", "386", "", "i386"},
+}
+
+// Map an OCI/Docker platform to the appc os and arch labels. The arch may
+// carry its variant, e.g. "arm/v7"; appc names are accepted as is.
+func ociToACIPlatform(os, arch, variant string) (string, string, error) {
+	os = strings.ToLower(os)
+	arch = strings.ToLower(arch)
+	if i := strings.Index(arch, "/"); i >= 0 && variant == "" {
+		variant = arch[i+1:]
+		arch = arch[:i]
+	}
+	variant = strings.ToLower(variant)
+
+	for _, p := range platformMaps {
+		if p.OS == os && p.Arch == arch && p.Variant == variant {
+			return os, p.ACIArch, nil
+		}
+	}
+	if variant == "" {
+		for _, p := range platformMaps {
+			if p.OS == os && p.ACIArch == arch {
+				return os, p.ACIArch, nil
+			}
+		}
+	}
+
+	if variant != "" {
+		arch += "/" + variant
+	}
+	return "", "", fmt.Errorf("unsupported os/arch %s/%s", os, arch)
+}
+
+// Tell whether an OCI/Docker os is mapped to an appc one
+func knownOS(os string) bool {
+	for _, p := range platformMaps {
+		if p.OS == strings.ToLower(os) {
+			return true
+		}
+	}
+	return false
+}
+
+// Map the appc os and arch labels to an OCI/Docker os, arch and variant
+func aciToOCIPlatform(os, arch string) (string, string, string, error) {
+	for _, p := range platformMaps {
+		if p.OS == os && p.ACIArch == arch {
+			return p.OS, p.Arch, p.Variant, nil
+		}
+	}
+	return "", "", "", fmt.Errorf("unsupported os/arch %s/%s", os, arch)
+}
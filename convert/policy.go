@@ -0,0 +1,131 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Policy is the file format, in YAML or JSON, of the fields a strict
+// conversion may drop or approximate
+type Policy struct {
+	Allow []AllowedField `yaml:"allow" json:"allow"`
+}
+
+// AllowedField is a field a strict conversion may lose. Field is a JSON
+// pointer which also allows the fields below it, and may hold the wildcards
+// of path.Match. It doesn't allow the fields above it, such as an array
+// reported as a whole. An empty File allows the field in both bundle files,
+// an empty Status allows it to be dropped or approximated.
+type AllowedField struct {
+	File   string      `yaml:"file" json:"file"`
+	Field  string      `yaml:"field" json:"field"`
+	Status FieldStatus `yaml:"status" json:"status"`
+}
+
+// LoadPolicy reads a policy file
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is a subset of YAML, so both are parsed the same way
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("unmarshal policy file %s failed: %v", file, err)
+	}
+	for _, a := range p.Allow {
+		if !strings.HasPrefix(a.Field, "/") {
+			return nil, fmt.Errorf("policy file %s: field %q is not a JSON pointer", file, a.Field)
+		}
+		if _, err := path.Match(a.Field, a.Field); err != nil {
+			return nil, fmt.Errorf("policy file %s: field %q: %v", file, a.Field, err)
+		}
+		switch a.Status {
+		case "", FieldDropped, FieldApproximated:
+		default:
+			return nil, fmt.Errorf("policy file %s: invalid status %q of field %s", file, a.Status, a.Field)
+		}
+	}
+	return &p, nil
+}
+
+// WithPolicy sets the fields a strict conversion may lose
+func WithPolicy(p *Policy) Option {
+	return func(c *Converter) error {
+		c.policy = p
+		return nil
+	}
+}
+
+// WithPolicyFile sets the fields a strict conversion may lose from a
+// policy file
+func WithPolicyFile(path string) Option {
+	return func(c *Converter) error {
+		if path == "" {
+			return nil
+		}
+		p, err := LoadPolicy(path)
+		if err != nil {
+			return err
+		}
+		c.policy = p
+		return nil
+	}
+}
+
+// Allows tells whether the policy allows to lose the field of the report
+func (p *Policy) Allows(f FieldReport) bool {
+	if p == nil || f.Status == FieldMapped {
+		return false
+	}
+	for _, a := range p.Allow {
+		if a.File != "" && a.File != f.File {
+			continue
+		}
+		if a.Status != "" && a.Status != f.Status {
+			continue
+		}
+		// The pattern allows the field or one of its parents
+		for ptr := f.Field; ptr != ""; ptr = ptr[:strings.LastIndex(ptr, "/")] {
+			if ok, _ := path.Match(a.Field, ptr); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Mark the fields of the report the policy allows to lose, and return the
+// other ones which are not mapped exactly
+func (c *Converter) checkLoss(r *Report) []FieldReport {
+	var lost []FieldReport
+	for i := range r.Fields {
+		f := &r.Fields[i]
+		if f.Status == FieldMapped {
+			continue
+		}
+		if c.policy.Allows(*f) {
+			f.Allowed = true
+			continue
+		}
+		lost = append(lost, *f)
+	}
+	return lost
+}
@@ -0,0 +1,157 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// Image annotation listing exposed ports as "port[-end][/proto]" separated
+// by ',' or ' '
+const ExposedPortsAnnotation = "org.opencontainers.image.exposedPorts"
+
+// Generate the ports of the aci app. Ports come from the ExposedPorts and
+// annotations of the image config and from the command line, in that
+// order; a later port replaces an earlier one of the same name.
+func (c *Converter) genPorts(imgConfig *ImageConfig) ([]types.Port, error) {
+	var ports []types.Port
+
+	if imgConfig != nil {
+		var exposed []string
+		// Field of the image config each port comes from
+		field := map[string]string{}
+		for p := range imgConfig.Config.ExposedPorts {
+			exposed = append(exposed, p)
+			field[p] = "/config/ExposedPorts"
+		}
+		if anno, ok := imgConfig.Config.Labels[ExposedPortsAnnotation]; ok {
+			for _, p := range strings.FieldsFunc(anno, func(r rune) bool {
+				return r == ',' || r == ' '
+			}) {
+				exposed = append(exposed, p)
+				if _, ok := field[p]; !ok {
+					field[p] = "/config/Labels/" + ExposedPortsAnnotation
+				}
+			}
+		}
+		// Keep the manifest stable across conversions
+		sort.Strings(exposed)
+		for _, e := range exposed {
+			port, err := parseExposedPort(e)
+			if err != nil {
+				return nil, &SpecError{File: c.imageConfigPath, Field: field[e], Err: err}
+			}
+			ports = addPort(ports, *port)
+		}
+	}
+
+	for _, f := range c.ports {
+		port, err := parsePortFlag(f)
+		if err != nil {
+			return nil, err
+		}
+		ports = addPort(ports, *port)
+	}
+
+	return ports, nil
+}
+
+func addPort(ports []types.Port, port types.Port) []types.Port {
+	for i := range ports {
+		if ports[i].Name == port.Name {
+			ports[i] = port
+			return ports
+		}
+	}
+	return append(ports, port)
+}
+
+// Parse a port of the image config such as "80/tcp" or "5000-5009/udp",
+// it is named after its protocol and first port, e.g. "tcp-80"
+func parseExposedPort(s string) (*types.Port, error) {
+	proto := "tcp"
+	portRange := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		portRange = s[:i]
+		proto = s[i+1:]
+	}
+	port, err := newPort(proto+"-"+strings.SplitN(portRange, "-", 2)[0], proto, portRange)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exposed port %q: %v", s, err)
+	}
+	return port, nil
+}
+
+// Parse a port given on the command line
+func parsePortFlag(s string) (*types.Port, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, fmt.Errorf("invalid port %q, expected name:proto:port[-end][:socketActivated]", s)
+	}
+	port, err := newPort(fields[0], fields[1], fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %v", s, err)
+	}
+	if len(fields) == 4 {
+		if fields[3] != "socketActivated" {
+			return nil, fmt.Errorf("invalid port %q: unknown option %q", s, fields[3])
+		}
+		port.SocketActivated = true
+	}
+	return port, nil
+}
+
+func newPort(name, proto, portRange string) (*types.Port, error) {
+	acn, err := types.NewACName(name)
+	if err != nil {
+		return nil, err
+	}
+	proto = strings.ToLower(proto)
+	if proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("unsupported protocol %q", proto)
+	}
+
+	s := strings.SplitN(portRange, "-", 2)
+	start, err := strconv.ParseUint(s[0], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	end := start
+	if len(s) == 2 {
+		end, err = strconv.ParseUint(s[1], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, fmt.Errorf("end of port range %d is lower than its start %d", end, start)
+		}
+	}
+
+	port := new(types.Port)
+	port.Name = *acn
+	port.Protocol = proto
+	port.Port = uint(start)
+	port.Count = uint(end - start + 1)
+	// types.Port validates itself when it's marshalled
+	if _, err := json.Marshal(port); err != nil {
+		return nil, err
+	}
+	return port, nil
+}
@@ -0,0 +1,96 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Phase is a step of a conversion
+type Phase string
+
+const (
+	// Validating the oci bundle
+	PhaseValidate Phase = "validate"
+	// Unpacking the layers of an image layout to a bundle
+	PhaseUnpack Phase = "unpack"
+	// Copying the rootfs of the bundle to the aci layout
+	PhaseCopy Phase = "copy"
+	// Generating the aci manifest
+	PhaseManifest Phase = "manifest"
+	// Writing the rootfs to the aci
+	PhaseBuild Phase = "build"
+	// Checking the aci as a runtime would use it
+	PhaseVerify Phase = "verify"
+	// Moving the aci to its destination
+	PhaseStore Phase = "store"
+	// The aci is complete
+	PhaseDone Phase = "done"
+)
+
+// Progress is an event of a running conversion. Totals are zero if they
+// are not known in the phase.
+type Progress struct {
+	Phase Phase
+	// os/arch of the aci being converted from an image layout, empty for
+	// an oci bundle
+	Platform string
+	// Files and bytes of file content processed so far in the phase
+	Files      int64
+	TotalFiles int64
+	Bytes      int64
+	TotalBytes int64
+	// Bytes written to the aci so far
+	Written int64
+	// Image ID of the aci, in the done phase
+	ImageID string
+}
+
+// ProgressFunc receives the progress events of a conversion. It is called
+// from the goroutine running the conversion and should return quickly.
+type ProgressFunc func(Progress)
+
+// WithProgress sets the function receiving the progress events
+func WithProgress(fn ProgressFunc) Option {
+	return func(c *Converter) error {
+		c.progressFn = fn
+		return nil
+	}
+}
+
+func (c *Converter) progress(p Progress) {
+	if c.progressFn == nil {
+		return
+	}
+	p.Platform = c.platform
+	c.progressFn(p)
+}
+
+// Writer counting the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+// Bytes written so far, the compressor may write from another goroutine
+func (cw *countingWriter) written() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
@@ -0,0 +1,250 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldStatus tells what the conversion did with a field of the bundle
+type FieldStatus string
+
+const (
+	// The field is represented exactly in the aci
+	FieldMapped FieldStatus = "mapped"
+	// The field is represented with a different meaning or precision
+	FieldApproximated FieldStatus = "approximated"
+	// The field is lost
+	FieldDropped FieldStatus = "dropped"
+)
+
+// FieldReport is what the conversion did with one field of the bundle
+type FieldReport struct {
+	// ConfigFile or RuntimeFile, and the JSON pointer of the field
+	File   string      `json:"file"`
+	Field  string      `json:"field"`
+	Status FieldStatus `json:"status"`
+	// Part of the aci manifest the field is mapped to
+	Target string `json:"target,omitempty"`
+	// How the field is approximated, or why it is dropped
+	Note string `json:"note,omitempty"`
+	// Whether the policy of a strict conversion allows to lose the field
+	Allowed bool `json:"allowed,omitempty"`
+}
+
+// Report lists what the conversion of a bundle did with each of its fields
+type Report struct {
+	Source   string        `json:"source"`
+	Platform string        `json:"platform,omitempty"`
+	Fields   []FieldReport `json:"fields"`
+}
+
+// ReportFunc receives the report of each converted bundle
+type ReportFunc func(*Report)
+
+// WithReport sets the function receiving the report of each converted
+// bundle, an image layout has one per platform
+func WithReport(fn ReportFunc) Option {
+	return func(c *Converter) error {
+		c.reportFn = fn
+		return nil
+	}
+}
+
+// Count returns the number of fields of the given status
+func (r *Report) Count(status FieldStatus) int {
+	n := 0
+	for _, f := range r.Fields {
+		if f.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteSummary writes a human readable summary of the report, fields
+// which are not mapped exactly are listed one per line
+func (r *Report) WriteSummary(w io.Writer) error {
+	var buf bytes.Buffer
+	source := r.Source
+	if r.Platform != "" {
+		source += " (" + r.Platform + ")"
+	}
+	fmt.Fprintf(&buf, "Conversion of %s: %d mapped, %d approximated, %d dropped\n", source,
+		r.Count(FieldMapped), r.Count(FieldApproximated), r.Count(FieldDropped))
+	for _, f := range r.Fields {
+		if f.Status == FieldMapped {
+			continue
+		}
+		fmt.Fprintf(&buf, "  %-12s %s %s", f.Status, f.File, f.Field)
+		if f.Target != "" {
+			fmt.Fprintf(&buf, " -> %s", f.Target)
+		}
+		if f.Note != "" {
+			fmt.Fprintf(&buf, ": %s", f.Note)
+		}
+		if f.Allowed {
+			buf.WriteString(" (allowed)")
+		}
+		buf.WriteString("\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Mapped reports that field of file is represented exactly by target
+func (b *Bundle) Mapped(file, field, target string) {
+	b.addField(FieldReport{File: file, Field: field, Status: FieldMapped, Target: target})
+}
+
+// Approximated reports that field of file is represented by target, with a
+// difference described by how
+func (b *Bundle) Approximated(file, field, target, how string) {
+	b.addField(FieldReport{File: file, Field: field, Status: FieldApproximated, Target: target, Note: how})
+}
+
+// Dropped reports that field of file is lost, for the reason why
+func (b *Bundle) Dropped(file, field, why string) {
+	b.addField(FieldReport{File: file, Field: field, Status: FieldDropped, Note: why})
+}
+
+// A later report of a field replaces the earlier one, so a mapper may
+// override what a previous one did
+func (b *Bundle) addField(f FieldReport) {
+	for i := range b.report.Fields {
+		if b.report.Fields[i].File == f.File && b.report.Fields[i].Field == f.Field {
+			b.report.Fields[i] = f
+			return
+		}
+	}
+	b.report.Fields = append(b.report.Fields, f)
+}
+
+// Why the fields no built-in mapper handles are dropped
+var dropReasons = map[string]string{
+	ConfigFile + " /process/terminal":         "the terminal is set up by the pod, not the image",
+	RuntimeFile + " /mounts":                  "mount sources are volumes of the pod, not of the image",
+	RuntimeFile + " /linux/uidMappings":       "appc has no user namespace mappings in the image",
+	RuntimeFile + " /linux/gidMappings":       "appc has no user namespace mappings in the image",
+	RuntimeFile + " /linux/rlimits":           "appc has no rlimit isolator",
+	RuntimeFile + " /linux/sysctl":            "appc has no sysctl isolator",
+	RuntimeFile + " /linux/cgroupsPath":       "the cgroups are set up by the aci runtime",
+	RuntimeFile + " /linux/namespaces":        "the namespaces are set up by the aci runtime",
+	RuntimeFile + " /linux/devices":           "appc has no device isolator",
+	RuntimeFile + " /linux/seccomp":           "appc has no seccomp isolator",
+	RuntimeFile + " /linux/rootfsPropagation": "appc has no rootfs propagation setting",
+	RuntimeFile + " /linux/resources":         "appc has no isolator for this resource",
+}
+
+// Report the fields of the bundle file data which no mapper reported on as
+// dropped. Zero values carry nothing to lose and are skipped.
+func (b *Bundle) reportUnhandled(file string, data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return newSpecError(file, err)
+	}
+	var handled []string
+	for _, f := range b.report.Fields {
+		if f.File == file {
+			handled = append(handled, f.Field)
+		}
+	}
+	b.walkUnhandled(file, "", v, handled)
+	return nil
+}
+
+func (b *Bundle) walkUnhandled(file, ptr string, v interface{}, handled []string) {
+	partly := false
+	for _, h := range handled {
+		if h == ptr || strings.HasPrefix(ptr, h+"/") {
+			return
+		}
+		if strings.HasPrefix(h, ptr+"/") {
+			partly = true
+		}
+	}
+	if isZero(v) {
+		return
+	}
+	// Objects are reported field by field down to the fields with a known
+	// reason, arrays as a whole unless a mapper handled part of them
+	_, known := dropReasons[file+" "+ptr]
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if known && !partly {
+			break
+		}
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.walkUnhandled(file, ptr+"/"+escapePointer(k), v[k], handled)
+		}
+		return
+	case []interface{}:
+		if !partly {
+			break
+		}
+		for i, e := range v {
+			b.walkUnhandled(file, ptr+"/"+strconv.Itoa(i), e, handled)
+		}
+		return
+	}
+
+	why := "no mapper handles it"
+	// The reason of the closest parent with a known one
+	for p := ptr; p != ""; p = p[:strings.LastIndex(p, "/")] {
+		if reason, ok := dropReasons[file+" "+p]; ok {
+			why = reason
+			break
+		}
+	}
+	b.Dropped(file, ptr, why)
+}
+
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		for _, e := range v {
+			if !isZero(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Escape a key for a JSON pointer, as RFC 6901 tells
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
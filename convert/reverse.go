@@ -0,0 +1,329 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/opencontainers/specs"
+)
+
+// ConvertToBundle converts the aci in aciPath back to an oci bundle in the
+// directory dstDir, which must not exist or be empty. The config.json and
+// runtime.json kept in the aci by WithStash are restored byte for byte, as
+// the files embedded by WithExtraFiles, and the files oci2aci added to the
+// rootfs are removed. Without them the bundle files are generated from the
+// manifest, and what appc can't tell is lost.
+func (c *Converter) ConvertToBundle(ctx context.Context, aciPath, dstDir string) error {
+	if entries, err := ioutil.ReadDir(dstDir); err == nil && len(entries) != 0 {
+		return fmt.Errorf("bundle directory %s is not empty", dstDir)
+	}
+	// On failure a directory the conversion created is removed, one which
+	// was there is emptied
+	_, statErr := os.Lstat(dstDir)
+	created := os.IsNotExist(statErr)
+	cleanup := func() {
+		if created {
+			os.RemoveAll(dstDir)
+			return
+		}
+		entries, _ := ioutil.ReadDir(dstDir)
+		for _, e := range entries {
+			os.RemoveAll(filepath.Join(dstDir, e.Name()))
+		}
+	}
+	rootfs := filepath.Join(dstDir, RootfsDir)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		cleanup()
+		return &BuildError{Op: "create bundle", Path: dstDir, Err: err}
+	}
+
+	m, err := c.extractACI(ctx, aciPath, rootfs)
+	if err != nil {
+		cleanup()
+		return contextErr(ctx, err)
+	}
+
+	c.progress(Progress{Phase: PhaseManifest})
+	if err := restoreExtraFiles(rootfs, dstDir); err != nil {
+		cleanup()
+		return &BuildError{Op: "restore bundle files", Path: dstDir, Err: err}
+	}
+	config, runtime, err := c.restoreBundleFiles(m, rootfs)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	for name, data := range map[string][]byte{ConfigFile: config, RuntimeFile: runtime} {
+		if err := ioutil.WriteFile(filepath.Join(dstDir, name), data, 0644); err != nil {
+			cleanup()
+			return &BuildError{Op: "write bundle", Path: dstDir, Err: err}
+		}
+	}
+	// The restored config.json may name the rootfs otherwise
+	if root := declaredRootPath(dstDir); filepath.IsAbs(root) {
+		c.logger.Warnf("config.json names the rootfs %s outside of the bundle, it is restored in %s", root, rootfs)
+	} else if filepath.Clean(root) != RootfsDir {
+		target := filepath.Join(dstDir, root)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			cleanup()
+			return &BuildError{Op: "write bundle", Path: target, Err: err}
+		}
+		if err := os.Rename(rootfs, target); err != nil {
+			cleanup()
+			return &BuildError{Op: "write bundle", Path: target, Err: err}
+		}
+	}
+	c.progress(Progress{Phase: PhaseDone})
+	c.logger.Debugf("Bundle:%v generated successfully", dstDir)
+	return nil
+}
+
+// Extract the rootfs of the aci to rootfs and return its manifest
+func (c *Converter) extractACI(ctx context.Context, aciPath, rootfs string) (*schema.ImageManifest, error) {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		return nil, &BuildError{Op: "open image", Path: aciPath, Err: err}
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, &BuildError{Op: "read image", Path: aciPath, Err: err}
+	}
+	defer r.Close()
+
+	var manifest []byte
+	p := Progress{Phase: PhaseUnpack}
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &BuildError{Op: "read image", Path: aciPath, Err: err}
+		}
+		if escapesRoot(hdr.Name) {
+			c.logger.Warnf("Skip entry %s of %s, it escapes the image", hdr.Name, aciPath)
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == aci.ManifestFile:
+			manifest, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, &BuildError{Op: "read image", Path: aciPath, Err: err}
+			}
+		case name == RootfsDir || strings.HasPrefix(name, RootfsDir+"/"):
+			// Keep every entry inside the rootfs, hard links name the
+			// entries of the image
+			name = path.Clean("/" + strings.TrimPrefix(name, RootfsDir))
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = strings.TrimPrefix(path.Clean(hdr.Linkname), RootfsDir+"/")
+			}
+			if err := c.extractEntry(tr, hdr, rootfs, name, &p); err != nil {
+				return nil, &BuildError{Op: "extract image", Path: name, Err: err}
+			}
+		default:
+			c.logger.Debugf("Skip %s outside of the aci rootfs", hdr.Name)
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s has no %s", aciPath, aci.ManifestFile)
+	}
+
+	var m schema.ImageManifest
+	if err := m.UnmarshalJSON(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of %s: %v", aciPath, err)
+	}
+	return &m, nil
+}
+
+// Return the bundle files kept in the aci, and remove the files oci2aci
+// added to the rootfs. The bundle files are generated from the manifest if
+// the aci doesn't keep them.
+func (c *Converter) restoreBundleFiles(m *schema.ImageManifest, rootfs string) ([]byte, []byte, error) {
+	var config, runtime []byte
+	if value, ok := m.Annotations.Get(StashConfigAnnotation); ok {
+		config = []byte(value)
+		value, _ = m.Annotations.Get(StashRuntimeAnnotation)
+		runtime = []byte(value)
+	} else if data, err := ioutil.ReadFile(filepath.Join(rootfs, StashDir, ConfigFile)); err == nil {
+		config = data
+		runtime, err = ioutil.ReadFile(filepath.Join(rootfs, StashDir, RuntimeFile))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if value, ok := m.Annotations.Get(StashFilesAnnotation); ok {
+		var added []string
+		if err := json.Unmarshal([]byte(value), &added); err != nil {
+			return nil, nil, fmt.Errorf("invalid annotation %s: %v", StashFilesAnnotation, err)
+		}
+		// Files first, then the directories holding them
+		for i := len(added) - 1; i >= 0; i-- {
+			if err := os.Remove(filepath.Join(rootfs, path.Clean("/"+added[i]))); err != nil && !os.IsNotExist(err) {
+				c.logger.Warnf("Keep %s added by oci2aci: %v", added[i], err)
+			}
+		}
+	}
+
+	if config != nil {
+		return config, runtime, nil
+	}
+	c.logger.Warnf("The aci doesn't keep the bundle files, they are generated from its manifest")
+	spec, runSpec, err := c.genBundleSpec(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config, err = json.MarshalIndent(spec, "", "\t"); err != nil {
+		return nil, nil, err
+	}
+	if runtime, err = json.MarshalIndent(runSpec, "", "\t"); err != nil {
+		return nil, nil, err
+	}
+	return config, runtime, nil
+}
+
+// Generate config.json and runtime.json from the aci manifest, the reverse
+// of the built-in mappers
+func (c *Converter) genBundleSpec(m *schema.ImageManifest) (*specs.LinuxSpec, *specs.LinuxRuntimeSpec, error) {
+	spec := new(specs.LinuxSpec)
+	runSpec := new(specs.LinuxRuntimeSpec)
+
+	spec.Version = specs.Version
+	if value, ok := m.Annotations.Get(OCIVersionName); ok {
+		spec.Version = value
+	}
+	aciOS, _ := m.Labels.Get("os")
+	aciArch, _ := m.Labels.Get("arch")
+	if aciOS != "" && aciArch != "" {
+		ociOS, ociArch, _, err := aciToOCIPlatform(aciOS, aciArch)
+		if err != nil {
+			return nil, nil, &UnsupportedFieldError{Fields: []FieldReport{{
+				File:   aci.ManifestFile,
+				Field:  "/labels",
+				Status: FieldDropped,
+				Note:   err.Error(),
+			}}}
+		}
+		spec.Platform.OS = ociOS
+		spec.Platform.Arch = ociArch
+	}
+	spec.Root.Path = RootfsDir
+	spec.Hostname, _ = m.Annotations.Get(HostnameName)
+	runSpec.Linux.ApparmorProfile, _ = m.Annotations.Get(AppArmorProfileName)
+
+	app := m.App
+	if app == nil {
+		return spec, runSpec, nil
+	}
+	spec.Process.Args = app.Exec
+	if len(app.Exec) > 1 && app.Exec[0] == path.Join(HooksDir, "post-start") {
+		c.logger.Warnf("Drop the poststart hooks, their wrapper can't be converted back")
+		spec.Process.Args = app.Exec[1:]
+	}
+	spec.Process.Cwd = app.WorkingDirectory
+	for _, env := range app.Environment {
+		spec.Process.Env = append(spec.Process.Env, env.Name+"="+env.Value)
+	}
+	spec.Process.User.UID = c.parseID("user", app.User)
+	spec.Process.User.GID = c.parseID("group", app.Group)
+	for _, gid := range app.SupplementaryGIDs {
+		spec.Process.User.AdditionalGids = append(spec.Process.User.AdditionalGids, uint32(gid))
+	}
+
+	for _, event := range app.EventHandlers {
+		if len(event.Exec) == 0 {
+			continue
+		}
+		if strings.HasPrefix(event.Exec[0], HooksDir+"/") {
+			c.logger.Warnf("Drop the %s hooks, their wrapper can't be converted back", event.Name)
+			continue
+		}
+		hook := specs.Hook{Path: event.Exec[0], Args: event.Exec[1:]}
+		switch event.Name {
+		case "pre-start":
+			runSpec.Hooks.Prestart = append(runSpec.Hooks.Prestart, hook)
+		case "post-stop":
+			runSpec.Hooks.Poststop = append(runSpec.Hooks.Poststop, hook)
+		}
+	}
+
+	if len(app.MountPoints) != 0 {
+		c.logger.Warnf("The aci tells no source of its mount points, runtime.json has no mounts")
+	}
+	for _, mount := range app.MountPoints {
+		spec.Mounts = append(spec.Mounts, specs.MountPoint{Name: mount.Name.String(), Path: mount.Path})
+	}
+
+	for _, isolator := range app.Isolators {
+		if isolator.ValueRaw == nil {
+			continue
+		}
+		switch isolator.Name {
+		case types.LinuxCapabilitiesRetainSetName:
+			var capSet IsolatorCapSet
+			if err := json.Unmarshal(*isolator.ValueRaw, &capSet); err != nil {
+				return nil, nil, fmt.Errorf("invalid isolator %s: %v", isolator.Name, err)
+			}
+			spec.Linux.Capabilities = capSet.Sets
+		case SELinuxContextName:
+			var context IsolatorSELinuxContext
+			if err := json.Unmarshal(*isolator.ValueRaw, &context); err != nil {
+				return nil, nil, fmt.Errorf("invalid isolator %s: %v", isolator.Name, err)
+			}
+			runSpec.Linux.SelinuxProcessLabel = strings.Join([]string{context.User, context.Role, context.Type, context.Level}, ":")
+		case ReadOnlyRootfsName:
+			var readOnly IsolatorReadOnlyRootfs
+			if err := json.Unmarshal(*isolator.ValueRaw, &readOnly); err != nil {
+				return nil, nil, fmt.Errorf("invalid isolator %s: %v", isolator.Name, err)
+			}
+			spec.Root.Readonly = readOnly.ReadOnly
+		default:
+			c.logger.Warnf("Drop isolator %s, it has no oci equivalent", isolator.Name)
+		}
+	}
+	return spec, runSpec, nil
+}
+
+// Parse a numeric user or group of the aci, names can't be resolved
+func (c *Converter) parseID(kind, id string) uint32 {
+	if id == "" {
+		return 0
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		c.logger.Warnf("The %s %q of the aci is not numeric, 0 is used", kind, id)
+		return 0
+	}
+	return uint32(n)
+}
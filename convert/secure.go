@@ -0,0 +1,144 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithStripSetID clears the setuid and setgid bits of the files of the aci
+// rootfs
+func WithStripSetID(strip bool) Option {
+	return func(c *Converter) error {
+		c.stripSetID = strip
+		return nil
+	}
+}
+
+// WithStripWorldWritable clears the write permission of others on the
+// regular files and the directories of the aci rootfs which are not sticky
+func WithStripWorldWritable(strip bool) Option {
+	return func(c *Converter) error {
+		c.stripWorldWritable = strip
+		return nil
+	}
+}
+
+// Join name to rootfs as if rootfs was the root directory: the symlinks of
+// the parent directories are resolved inside rootfs, absolute ones from
+// rootfs and ".." stops at it, so that the result never escapes rootfs.
+// The last element is resolved too if followLast is set.
+func secureJoin(rootfs, name string, followLast bool) (string, error) {
+	rest := splitPath(name)
+	resolved := "/"
+	links := 0
+	for len(rest) != 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		cur := path.Join(resolved, elem)
+		if len(rest) == 0 && !followLast {
+			resolved = cur
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(rootfs, cur))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = cur
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, cur))
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		rest = append(splitPath(target), rest...)
+		resolved = "/"
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// The elements of p once cleaned as an absolute path, so ".." can't go up
+// from the root
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// Tell whether an entry name of an archive points out of the directory it
+// is extracted to
+func escapesRoot(name string) bool {
+	if path.IsAbs(name) {
+		return true
+	}
+	return name == ".." || strings.HasPrefix(path.Clean(name), "../")
+}
+
+// The entries of the aci rootfs which are worth a look when the bundle is
+// not trusted
+type riskyFiles struct {
+	setID         []string
+	worldWritable []string
+}
+
+// Record a risky entry of the aci rootfs at p, and clear its special bits
+// if the converter strips them
+func (c *Converter) checkRisky(hdr *tar.Header, p string, risky *riskyFiles) {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+	default:
+		return
+	}
+	if hdr.Typeflag != tar.TypeDir && hdr.Mode&(04000|02000) != 0 {
+		risky.setID = append(risky.setID, p)
+		if c.stripSetID {
+			hdr.Mode &^= 04000 | 02000
+		}
+	}
+	// Sticky directories such as /tmp are world writable on purpose
+	if hdr.Mode&0002 != 0 && hdr.Mode&01000 == 0 {
+		risky.worldWritable = append(risky.worldWritable, p)
+		if c.stripWorldWritable {
+			hdr.Mode &^= 0002
+		}
+	}
+}
+
+func (c *Converter) reportRisky(risky *riskyFiles) {
+	if len(risky.setID) != 0 {
+		how := "kept"
+		if c.stripSetID {
+			how = "cleared"
+		}
+		c.logger.Warnf("%d setuid or setgid files in the rootfs, the bits are %s: %s", len(risky.setID), how, strings.Join(risky.setID, ", "))
+	}
+	if len(risky.worldWritable) != 0 {
+		how := "kept"
+		if c.stripWorldWritable {
+			how = "cleared"
+		}
+		c.logger.Warnf("%d world writable files or directories in the rootfs, the write permission of others is %s: %s", len(risky.worldWritable), how, strings.Join(risky.worldWritable, ", "))
+	}
+}
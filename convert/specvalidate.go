@@ -0,0 +1,456 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/specs"
+)
+
+// Fields of the schema added after the first supported spec version, and
+// the version which added them
+var fieldsSince = map[string]string{
+	RuntimeFile + " /hooks/poststart": "0.2.0",
+}
+
+// Capabilities of the linux capabilities(7) man page
+var validCapabilities = map[string]bool{
+	"CAP_CHOWN": true, "CAP_DAC_OVERRIDE": true, "CAP_DAC_READ_SEARCH": true,
+	"CAP_FOWNER": true, "CAP_FSETID": true, "CAP_KILL": true, "CAP_SETGID": true,
+	"CAP_SETUID": true, "CAP_SETPCAP": true, "CAP_LINUX_IMMUTABLE": true,
+	"CAP_NET_BIND_SERVICE": true, "CAP_NET_BROADCAST": true, "CAP_NET_ADMIN": true,
+	"CAP_NET_RAW": true, "CAP_IPC_LOCK": true, "CAP_IPC_OWNER": true,
+	"CAP_SYS_MODULE": true, "CAP_SYS_RAWIO": true, "CAP_SYS_CHROOT": true,
+	"CAP_SYS_PTRACE": true, "CAP_SYS_PACCT": true, "CAP_SYS_ADMIN": true,
+	"CAP_SYS_BOOT": true, "CAP_SYS_NICE": true, "CAP_SYS_RESOURCE": true,
+	"CAP_SYS_TIME": true, "CAP_SYS_TTY_CONFIG": true, "CAP_MKNOD": true,
+	"CAP_LEASE": true, "CAP_AUDIT_WRITE": true, "CAP_AUDIT_CONTROL": true,
+	"CAP_SETFCAP": true, "CAP_MAC_OVERRIDE": true, "CAP_MAC_ADMIN": true,
+	"CAP_SYSLOG": true, "CAP_WAKE_ALARM": true, "CAP_BLOCK_SUSPEND": true,
+	"CAP_AUDIT_READ": true,
+}
+
+// Resources of the linux getrlimit(2) man page
+var validRlimits = map[string]bool{
+	"RLIMIT_AS": true, "RLIMIT_CORE": true, "RLIMIT_CPU": true, "RLIMIT_DATA": true,
+	"RLIMIT_FSIZE": true, "RLIMIT_LOCKS": true, "RLIMIT_MEMLOCK": true,
+	"RLIMIT_MSGQUEUE": true, "RLIMIT_NICE": true, "RLIMIT_NOFILE": true,
+	"RLIMIT_NPROC": true, "RLIMIT_RSS": true, "RLIMIT_RTPRIO": true,
+	"RLIMIT_RTTIME": true, "RLIMIT_SIGPENDING": true, "RLIMIT_STACK": true,
+}
+
+var validNamespaces = map[specs.NamespaceType]bool{
+	specs.PIDNamespace: true, specs.NetworkNamespace: true, specs.MountNamespace: true,
+	specs.IPCNamespace: true, specs.UTSNamespace: true, specs.UserNamespace: true,
+}
+
+// The uid and gid of the kernel meaning no id, (uid_t)-1
+const invalidID = math.MaxUint32
+
+type specValidator struct {
+	version string
+	errs    []FieldError
+}
+
+func (v *specValidator) errorf(file, field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{File: file, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check the config.json and runtime.json of the bundle in path beyond their
+// syntax: the schema of their spec version, the values of the fields, and
+// that both files agree. A file which can't be parsed is reported by a
+// SpecError, the invalid fields by a ValidationError.
+func validateSpecs(path string) error {
+	config, err := ioutil.ReadFile(filepath.Join(path, ConfigFile))
+	if err != nil {
+		return err
+	}
+	runtime, err := ioutil.ReadFile(filepath.Join(path, RuntimeFile))
+	if err != nil {
+		return err
+	}
+
+	var spec specs.LinuxSpec
+	var runSpec specs.LinuxRuntimeSpec
+	if err := json.Unmarshal(config, &spec); err != nil {
+		return newSpecError(ConfigFile, err)
+	}
+	if err := json.Unmarshal(runtime, &runSpec); err != nil {
+		return newSpecError(RuntimeFile, err)
+	}
+	// The decoded structs don't tell the unknown fields
+	var rawConfig, rawRuntime interface{}
+	json.Unmarshal(config, &rawConfig)
+	json.Unmarshal(runtime, &rawRuntime)
+
+	v := &specValidator{version: spec.Version}
+	if v.checkVersion() {
+		v.checkSchema(ConfigFile, "", rawConfig, reflect.TypeOf(spec))
+		v.checkSchema(RuntimeFile, "", rawRuntime, reflect.TypeOf(runSpec))
+	}
+	v.checkConfig(spec)
+	v.checkRuntime(runSpec)
+	v.checkMounts(spec, runSpec)
+	v.checkIDMappings(spec, runSpec)
+	if len(v.errs) != 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	return nil
+}
+
+// Tell whether the spec version is one the schema of oci2aci supports
+func (v *specValidator) checkVersion() bool {
+	if v.version == "" {
+		v.errorf(ConfigFile, "/version", "no spec version")
+		return false
+	}
+	major, minor, _, err := parseSpecVersion(v.version)
+	if err != nil {
+		v.errorf(ConfigFile, "/version", "%v", err)
+		return false
+	}
+	if major != specs.VersionMajor || minor > specs.VersionMinor {
+		v.errorf(ConfigFile, "/version", "unsupported spec version %s, the latest supported one is %s", v.version, specs.Version)
+		return false
+	}
+	return true
+}
+
+// Parse a semantic version, its pre-release and build parts are ignored
+func parseSpecVersion(version string) (int, int, int, error) {
+	s := version
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("invalid spec version %q, expected major.minor.patch", version)
+	}
+	var n [3]int
+	for i, p := range parts {
+		var err error
+		if n[i], err = strconv.Atoi(p); err != nil || n[i] < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid spec version %q, expected major.minor.patch", version)
+		}
+	}
+	return n[0], n[1], n[2], nil
+}
+
+// Report the fields of value which the schema of type t, the spec types of
+// the supported version, doesn't have
+func (v *specValidator) checkSchema(file, ptr string, value interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(t)
+			for _, k := range keys {
+				field := ptr + "/" + escapePointer(k)
+				ft, ok := lookupField(fields, k)
+				if !ok {
+					v.errorf(file, field, "unknown field in spec version %s", v.version)
+					continue
+				}
+				if since, ok := fieldsSince[file+" "+field]; ok && !isZero(value[k]) && compareVersions(v.version, since) < 0 {
+					v.errorf(file, field, "field added in spec version %s, the bundle has version %s", since, v.version)
+					continue
+				}
+				v.checkSchema(file, field, value[k], ft)
+			}
+		case reflect.Map:
+			for _, k := range keys {
+				v.checkSchema(file, ptr+"/"+escapePointer(k), value[k], t.Elem())
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return
+		}
+		for i, e := range value {
+			v.checkSchema(file, ptr+"/"+strconv.Itoa(i), e, t.Elem())
+		}
+	}
+}
+
+// Return the types of the fields of the struct type t by their JSON name,
+// with the fields of the embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && name == "" {
+			for k, ft := range jsonFields(f.Type) {
+				fields[k] = ft
+			}
+			continue
+		}
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// Find a field like encoding/json does, which prefers an exact match of
+// the name but accepts any case
+func lookupField(fields map[string]reflect.Type, name string) (reflect.Type, bool) {
+	if ft, ok := fields[name]; ok {
+		return ft, true
+	}
+	for k, ft := range fields {
+		if strings.EqualFold(k, name) {
+			return ft, true
+		}
+	}
+	return nil, false
+}
+
+// Compare two valid spec versions
+func compareVersions(a, b string) int {
+	aMajor, aMinor, aPatch, _ := parseSpecVersion(a)
+	bMajor, bMinor, bPatch, _ := parseSpecVersion(b)
+	for _, d := range []int{aMajor - bMajor, aMinor - bMinor, aPatch - bPatch} {
+		if d != 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func (v *specValidator) checkConfig(spec specs.LinuxSpec) {
+	if spec.Platform.OS == "" {
+		v.errorf(ConfigFile, "/platform/os", "no operating system")
+	}
+	if spec.Platform.Arch == "" {
+		v.errorf(ConfigFile, "/platform/arch", "no architecture")
+	}
+	if spec.Root.Path == "" {
+		v.errorf(ConfigFile, "/root/path", "no rootfs path")
+	}
+	if len(spec.Hostname) > 64 {
+		v.errorf(ConfigFile, "/hostname", "hostname is longer than 64 characters")
+	}
+
+	process := spec.Process
+	if len(process.Args) == 0 {
+		v.errorf(ConfigFile, "/process/args", "no command to run")
+	} else if process.Args[0] == "" {
+		v.errorf(ConfigFile, "/process/args/0", "empty command")
+	}
+	if process.Cwd != "" && !path.IsAbs(process.Cwd) {
+		v.errorf(ConfigFile, "/process/cwd", "working directory %q is not absolute", process.Cwd)
+	}
+	v.checkEnv(ConfigFile, "/process/env", process.Env)
+	if process.User.UID == invalidID {
+		v.errorf(ConfigFile, "/process/user/uid", "uid %d is out of range", process.User.UID)
+	}
+	if process.User.GID == invalidID {
+		v.errorf(ConfigFile, "/process/user/gid", "gid %d is out of range", process.User.GID)
+	}
+	for i, gid := range process.User.AdditionalGids {
+		if gid == invalidID {
+			v.errorf(ConfigFile, fmt.Sprintf("/process/user/additionalGids/%d", i), "gid %d is out of range", gid)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, c := range spec.Linux.Capabilities {
+		field := fmt.Sprintf("/linux/capabilities/%d", i)
+		switch {
+		case !validCapabilities[c]:
+			v.errorf(ConfigFile, field, "unknown capability %q", c)
+		case seen[c]:
+			v.errorf(ConfigFile, field, "duplicate capability %s", c)
+		}
+		seen[c] = true
+	}
+}
+
+// Environment variables are NAME=value, and NAME can't be empty
+func (v *specValidator) checkEnv(file, ptr string, env []string) {
+	for i, e := range env {
+		if strings.Index(e, "=") > 0 {
+			continue
+		}
+		v.errorf(file, fmt.Sprintf("%s/%d", ptr, i), "environment variable %q is not NAME=value", e)
+	}
+}
+
+func (v *specValidator) checkRuntime(runSpec specs.LinuxRuntimeSpec) {
+	hooks := map[string][]specs.Hook{
+		"prestart":  runSpec.Hooks.Prestart,
+		"poststart": runSpec.Hooks.Poststart,
+		"poststop":  runSpec.Hooks.Poststop,
+	}
+	for _, name := range []string{"prestart", "poststart", "poststop"} {
+		for i, hook := range hooks[name] {
+			field := fmt.Sprintf("/hooks/%s/%d", name, i)
+			if !path.IsAbs(hook.Path) {
+				v.errorf(RuntimeFile, field+"/path", "hook path %q is not absolute", hook.Path)
+			}
+			v.checkEnv(RuntimeFile, field+"/env", hook.Env)
+			// The env of hooks is set by a shell script
+			for j, e := range hook.Env {
+				if k := strings.Index(e, "="); k > 0 && !hookEnvName.MatchString(e[:k]) {
+					v.errorf(RuntimeFile, fmt.Sprintf("%s/env/%d", field, j), "hook environment variable name %q is not a shell variable name", e[:k])
+				}
+			}
+		}
+	}
+
+	linux := runSpec.Linux
+	seen := map[string]bool{}
+	for i, rlimit := range linux.Rlimits {
+		field := fmt.Sprintf("/linux/rlimits/%d", i)
+		switch {
+		case !validRlimits[rlimit.Type]:
+			v.errorf(RuntimeFile, field+"/type", "unknown rlimit %q", rlimit.Type)
+		case seen[rlimit.Type]:
+			v.errorf(RuntimeFile, field+"/type", "duplicate rlimit %s", rlimit.Type)
+		}
+		seen[rlimit.Type] = true
+		if rlimit.Soft > rlimit.Hard {
+			v.errorf(RuntimeFile, field+"/soft", "soft limit %d is above the hard limit %d", rlimit.Soft, rlimit.Hard)
+		}
+	}
+
+	namespaces := map[specs.NamespaceType]bool{}
+	for i, ns := range linux.Namespaces {
+		field := fmt.Sprintf("/linux/namespaces/%d", i)
+		switch {
+		case !validNamespaces[ns.Type]:
+			v.errorf(RuntimeFile, field+"/type", "unknown namespace %q", ns.Type)
+		case namespaces[ns.Type]:
+			v.errorf(RuntimeFile, field+"/type", "duplicate namespace %s", ns.Type)
+		}
+		namespaces[ns.Type] = true
+		if ns.Path != "" && !path.IsAbs(ns.Path) {
+			v.errorf(RuntimeFile, field+"/path", "namespace path %q is not absolute", ns.Path)
+		}
+	}
+
+	for i, dev := range linux.Devices {
+		field := fmt.Sprintf("/linux/devices/%d", i)
+		if !path.IsAbs(dev.Path) {
+			v.errorf(RuntimeFile, field+"/path", "device path %q is not absolute", dev.Path)
+		}
+		switch dev.Type {
+		case 'c', 'b', 'u', 'p':
+		default:
+			v.errorf(RuntimeFile, field+"/type", "unknown device type %q", dev.Type)
+		}
+		if strings.Trim(dev.Permissions, "rwm") != "" {
+			v.errorf(RuntimeFile, field+"/permissions", "permissions %q are not made of r, w and m", dev.Permissions)
+		}
+	}
+}
+
+// The mount points of config.json are named after the mounts of
+// runtime.json, each name of one file must be in the other one
+func (v *specValidator) checkMounts(spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec) {
+	names := map[string]bool{}
+	for i, mount := range spec.Mounts {
+		field := fmt.Sprintf("/mounts/%d", i)
+		switch {
+		case mount.Name == "":
+			v.errorf(ConfigFile, field+"/name", "no mount name")
+		case names[mount.Name]:
+			v.errorf(ConfigFile, field+"/name", "duplicate mount %s", mount.Name)
+		default:
+			if _, ok := runSpec.Mounts[mount.Name]; !ok {
+				v.errorf(ConfigFile, field+"/name", "mount %s is not defined in %s", mount.Name, RuntimeFile)
+			}
+		}
+		names[mount.Name] = true
+		if !path.IsAbs(mount.Path) {
+			v.errorf(ConfigFile, field+"/path", "mount path %q is not absolute", mount.Path)
+		}
+	}
+
+	var keys []string
+	for name := range runSpec.Mounts {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		field := "/mounts/" + escapePointer(name)
+		if !names[name] {
+			v.errorf(RuntimeFile, field, "mount %s has no mount point in %s", name, ConfigFile)
+		}
+		if runSpec.Mounts[name].Type == "" {
+			v.errorf(RuntimeFile, field+"/type", "no mount type")
+		}
+	}
+}
+
+// The id mappings of the user namespace must not overflow nor overlap, and
+// map the user and group of the process
+func (v *specValidator) checkIDMappings(spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec) {
+	user := spec.Process.User
+	v.checkIDMapping("uidMappings", runSpec.Linux.UIDMappings, user.UID, "/process/user/uid")
+	v.checkIDMapping("gidMappings", runSpec.Linux.GIDMappings, user.GID, "/process/user/gid")
+}
+
+func (v *specValidator) checkIDMapping(name string, mappings []specs.IDMapping, id uint32, idField string) {
+	const maxID = uint64(math.MaxUint32) + 1
+	mapped := len(mappings) == 0
+	for i, m := range mappings {
+		field := fmt.Sprintf("/linux/%s/%d", name, i)
+		if m.Size == 0 {
+			v.errorf(RuntimeFile, field+"/size", "empty mapping")
+			continue
+		}
+		if uint64(m.ContainerID)+uint64(m.Size) > maxID {
+			v.errorf(RuntimeFile, field+"/size", "container ids overflow")
+		}
+		if uint64(m.HostID)+uint64(m.Size) > maxID {
+			v.errorf(RuntimeFile, field+"/size", "host ids overflow")
+		}
+		for j, prev := range mappings[:i] {
+			if uint64(m.ContainerID) < uint64(prev.ContainerID)+uint64(prev.Size) &&
+				uint64(prev.ContainerID) < uint64(m.ContainerID)+uint64(m.Size) {
+				v.errorf(RuntimeFile, field+"/containerID", "container ids overlap /linux/%s/%d", name, j)
+			}
+		}
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			mapped = true
+		}
+	}
+	if !mapped {
+		v.errorf(ConfigFile, idField, "id %d is not mapped by /linux/%s of %s", id, name, RuntimeFile)
+	}
+}
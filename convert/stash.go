@@ -0,0 +1,125 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/opencontainers/specs"
+)
+
+// Stash tells where the original config.json and runtime.json are kept in
+// the aci, so the bundle can be restored from it
+type Stash string
+
+const (
+	// The bundle files are not kept
+	StashNone Stash = ""
+	// The bundle files are kept in annotations
+	StashAnnotation Stash = "annotation"
+	// The bundle files are kept in the aci rootfs, in StashDir
+	StashFile Stash = "file"
+)
+
+const (
+	// Annotations carrying the original bundle files
+	StashConfigAnnotation  = "oci2aci/config.json"
+	StashRuntimeAnnotation = "oci2aci/runtime.json"
+	// Annotation listing, as a JSON array, the paths oci2aci added to the
+	// aci rootfs. They are removed when the bundle is restored.
+	StashFilesAnnotation = "oci2aci/files"
+	// Directory of the aci rootfs keeping the original bundle files
+	StashDir = HooksDir
+)
+
+// WithStash keeps the original config.json and runtime.json in the aci, so
+// that ConvertToBundle restores them byte for byte
+func WithStash(stash Stash) Option {
+	return func(c *Converter) error {
+		switch stash {
+		case StashNone, StashAnnotation, StashFile:
+		default:
+			return fmt.Errorf("invalid stash %q, expected %q or %q", stash, StashAnnotation, StashFile)
+		}
+		c.stash = stash
+		return nil
+	}
+}
+
+// Keep the bundle files as the converter tells, and list the files added to
+// the aci rootfs by the mappers run so far
+func mapStash(b *Bundle, spec specs.LinuxSpec, runSpec specs.LinuxRuntimeSpec, m *schema.ImageManifest) error {
+	if b.c.stash == StashNone {
+		return nil
+	}
+	config, err := ioutil.ReadFile(filepath.Join(b.Path, ConfigFile))
+	if err != nil {
+		return &BundleError{Path: b.Path, Err: err}
+	}
+	runtime, err := ioutil.ReadFile(filepath.Join(b.Path, RuntimeFile))
+	if err != nil {
+		return &BundleError{Path: b.Path, Err: err}
+	}
+
+	switch b.c.stash {
+	case StashAnnotation:
+		// Annotation values are JSON strings, which can't hold anything
+		// but UTF-8 unchanged
+		if !utf8.Valid(config) || !utf8.Valid(runtime) {
+			return fmt.Errorf("bundle files are not valid UTF-8, stash them as %q", StashFile)
+		}
+		m.Annotations.Set(types.ACIdentifier(StashConfigAnnotation), string(config))
+		m.Annotations.Set(types.ACIdentifier(StashRuntimeAnnotation), string(runtime))
+	case StashFile:
+		b.AddFile(filepath.Join(StashDir, ConfigFile), 0644, config)
+		b.AddFile(filepath.Join(StashDir, RuntimeFile), 0644, runtime)
+	}
+
+	// Directories created for the files are listed before them
+	var added []string
+	seen := map[string]bool{}
+	for _, f := range b.files {
+		var parents []string
+		for dir := filepath.Dir(f.Path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			if _, err := os.Lstat(filepath.Join(b.Rootfs, dir)); os.IsNotExist(err) {
+				added = append(added, dir)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(b.Rootfs, f.Path)); os.IsNotExist(err) {
+			added = append(added, f.Path)
+		} else {
+			b.Logger.Warnf("%s of the rootfs is replaced by oci2aci and can't be restored", f.Path)
+		}
+	}
+	bytes, err := json.Marshal(added)
+	if err != nil {
+		return err
+	}
+	m.Annotations.Set(types.ACIdentifier(StashFilesAnnotation), string(bytes))
+	return nil
+}
@@ -37,11 +37,11 @@ func (e *Err) Error() string {
 func run(cmd *exec.Cmd) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return errorf(err.Error())
+		return errorf("%v", err)
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return errorf(err.Error())
+		return errorf("%v", err)
 	}
 	go io.Copy(os.Stdout, stdout)
 	go io.Copy(os.Stderr, stderr)
@@ -14,6 +14,7 @@
 package convert
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -21,8 +22,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/Sirupsen/logrus"
 )
 
 const (
@@ -47,64 +46,159 @@ type validateRes struct {
 	runtime io.Reader
 }
 
-func validateOCIProc(path string) bool {
-	var bRes bool
-	if err := validateBundle(path); err != nil {
-		logrus.Debugf("%s: invalid oci bundle: %v.", path, err)
-		bRes = false
-	} else {
-		logrus.Debugf("%s: valid oci bundle.", path)
-		bRes = true
-	}
-	return bRes
+func (c *Converter) validateOCIProc(path string) error {
+	rootfs, err := c.bundleRootfs(path)
+	if err != nil {
+		c.logger.Debugf("%s: invalid oci bundle: %v.", path, err)
+		return &BundleError{Path: path, Err: err}
+	}
+	extra, err := validateBundle(path, rootfs)
+	if err != nil {
+		c.logger.Debugf("%s: invalid oci bundle: %v.", path, err)
+		return &BundleError{Path: path, Err: err}
+	}
+	if err := c.checkExtraFiles(path, extra); err != nil {
+		c.logger.Debugf("%s: invalid oci bundle: %v.", path, err)
+		return &BundleError{Path: path, Err: err}
+	}
+	if err := validateSpecs(path); err != nil {
+		c.logger.Debugf("%s: invalid oci bundle: %v.", path, err)
+		if _, ok := err.(*SpecError); ok {
+			return err
+		}
+		return &BundleError{Path: path, Err: err}
+	}
+	c.logger.Debugf("%s: valid oci bundle.", path)
+	return nil
 }
 
-func validateBundle(path string) error {
+// Check the layout of the bundle in path, whose rootfs may be outside of
+// it, and return the files it has besides config.json, runtime.json and
+// the rootfs, relative to path
+func validateBundle(path, rootfs string) ([]string, error) {
 	fi, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("error accessing bundle: %v", err)
+		return nil, fmt.Errorf("error accessing bundle: %v", err)
 	}
 	if !fi.IsDir() {
-		return fmt.Errorf("given path %q is not a directory", path)
+		return nil, fmt.Errorf("given path %q is not a directory", path)
+	}
+	// root.path may be absolute while path is relative, or go through a
+	// symlink, so the rootfs is found by its real path
+	realRootfs, err := realPath(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	isRootfs := func(fpath string) bool {
+		real, err := realPath(fpath)
+		return err == nil && real == realRootfs
 	}
 	var flist []string
 	var res validateRes
 	walkBundle := func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		rpath, err := filepath.Rel(path, fpath)
 		if err != nil {
 			return err
 		}
-		switch rpath {
-		case ".":
-		case ConfigFile:
+		switch {
+		case rpath == ".":
+		case isRootfs(fpath):
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+		case rpath == ConfigFile:
 			res.config, err = os.Open(fpath)
 			if err != nil {
 				return err
 			}
 			res.cfgOK = true
-		case RuntimeFile:
+		case rpath == RuntimeFile:
 			res.runtime, err = os.Open(fpath)
 			if err != nil {
 				return err
 			}
 			res.runOK = true
-		case RootfsDir:
-			if !fi.IsDir() {
-				return errors.New("rootfs is not a directory")
-			}
-			res.rfsOK = true
-		default:
+		case !fi.IsDir():
 			flist = append(flist, rpath)
 		}
 		return nil
 	}
 	if err := filepath.Walk(path, walkBundle); err != nil {
-		return err
+		return nil, err
+	}
+	// The rootfs may be a symlink, or outside of the bundle
+	if fi, err := os.Stat(rootfs); err == nil {
+		if !fi.IsDir() {
+			return nil, errors.New("rootfs is not a directory")
+		}
+		res.rfsOK = true
+	}
+	return flist, checkBundle(res)
+}
+
+// Return root.path of the config.json of the bundle in path, the default
+// one if it can't be read. The validation of config.json reports why.
+func declaredRootPath(path string) string {
+	var spec struct {
+		Root struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, ConfigFile))
+	if err == nil && json.Unmarshal(data, &spec) == nil && spec.Root.Path != "" {
+		return spec.Root.Path
 	}
-	return checkBundle(res, flist)
+	return RootfsDir
 }
 
-func checkBundle(res validateRes, files []string) error {
+// Resolve the rootfs directory of the bundle in path, which root.path
+// names relative to the bundle or absolute. It must be inside the bundle
+// unless the converter allows an external rootfs.
+func (c *Converter) bundleRootfs(path string) (string, error) {
+	root := declaredRootPath(path)
+	rootfs := root
+	if !filepath.IsAbs(root) {
+		rootfs = filepath.Join(path, root)
+	}
+	if c.externalRootfs {
+		return rootfs, nil
+	}
+
+	// Symlinks may lead out of the bundle too
+	bundleReal, err := realPath(path)
+	if err != nil {
+		return "", err
+	}
+	rootfsReal, err := realPath(rootfs)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(bundleReal, rootfsReal)
+	switch {
+	case err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)):
+		return "", fmt.Errorf("rootfs %s is outside of the bundle", root)
+	case rel == ".":
+		return "", fmt.Errorf("rootfs %s is the bundle directory", root)
+	}
+	return rootfs, nil
+}
+
+// The absolute path of p with its symlinks resolved, if it exists
+func realPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real, nil
+	}
+	return abs, nil
+}
+
+func checkBundle(res validateRes) error {
 	defer func() {
 		if rc, ok := res.config.(io.Closer); ok {
 			rc.Close()
@@ -130,11 +224,5 @@ func checkBundle(res validateRes, files []string) error {
 	if err != nil {
 		return fmt.Errorf("error reading the bundle: %v", err)
 	}
-
-	for _, f := range files {
-		if !strings.HasPrefix(f, "rootfs") {
-			return fmt.Errorf("unrecognized file path in bundle: %q", f)
-		}
-	}
 	return nil
 }
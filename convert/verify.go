@@ -0,0 +1,300 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// Links followed to resolve a path of the image, as the kernel does
+const maxSymlinks = 40
+
+// The rootfs of an aci, by the path of its entries inside the image
+type imageTree map[string]*tar.Header
+
+// Check the aci in imagePath the way a runtime would use it: its manifest
+// must parse, its isolators must be valid, the exec and event handler
+// binaries must be in the rootfs, and the mount points must be free
+// directories. The problems are reported by a ValidationError.
+func (c *Converter) verifyImage(ctx context.Context, imagePath string) error {
+	c.progress(Progress{Phase: PhaseVerify})
+	data, tree, err := readImage(ctx, imagePath)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return &ValidationError{Errors: []FieldError{{File: aci.ManifestFile, Field: "", Message: "no manifest in the image"}}}
+	}
+
+	var m schema.ImageManifest
+	if err := m.UnmarshalJSON(data); err != nil {
+		return &ValidationError{Errors: []FieldError{{File: aci.ManifestFile, Field: "", Message: err.Error()}}}
+	}
+	var v specValidator
+	v.checkManifest(&m, tree)
+	if len(v.errs) != 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	c.logger.Debugf("%s: valid aci.", imagePath)
+	return nil
+}
+
+// Check the manifest m of an aci streamed from the directory rootfs and the
+// generated files before it is written, as verifyImage checks an aci once
+// written: the image can't be read back from the stream.
+func (c *Converter) verifyManifest(ctx context.Context, m *schema.ImageManifest, rootfs string, files []aciFile) error {
+	c.progress(Progress{Phase: PhaseVerify})
+	entries, err := walkRootfs(ctx, rootfs, c.jobs)
+	if err != nil {
+		return &BuildError{Op: "walk rootfs", Path: rootfs, Err: err}
+	}
+	root := filepath.Dir(rootfs)
+	keep := c.rootfsFilter(rootfs, files)
+	tree := imageTree{}
+	for _, e := range entries {
+		hdr, err := entryHeader(root, e)
+		if err != nil {
+			return &BuildError{Op: "walk rootfs", Path: rootfs, Err: err}
+		}
+		if hdr != nil && keep(hdr) {
+			tree[imagePath(hdr)] = hdr
+		}
+	}
+	for _, f := range files {
+		tree[path.Clean("/"+f.Path)] = &tar.Header{
+			Name:     path.Join(RootfsDir, f.Path),
+			Mode:     int64(f.Mode.Perm()),
+			Typeflag: tar.TypeReg,
+		}
+	}
+
+	var v specValidator
+	v.checkManifest(m, tree)
+	if len(v.errs) != 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	c.logger.Debugf("%s: valid aci manifest.", rootfs)
+	return nil
+}
+
+// Read the manifest and the rootfs entries of the aci in imagePath
+func readImage(ctx context.Context, imagePath string) ([]byte, imageTree, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, nil, &BuildError{Op: "open image", Path: imagePath, Err: err}
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, nil, &BuildError{Op: "read image", Path: imagePath, Err: err}
+	}
+	defer r.Close()
+
+	var manifest []byte
+	tree := imageTree{}
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, &BuildError{Op: "read image", Path: imagePath, Err: err}
+		}
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == aci.ManifestFile:
+			manifest, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, nil, &BuildError{Op: "read image", Path: imagePath, Err: err}
+			}
+		case name == RootfsDir || strings.HasPrefix(name, RootfsDir+"/"):
+			tree[path.Clean("/"+strings.TrimPrefix(name, RootfsDir))] = hdr
+		}
+	}
+	return manifest, tree, nil
+}
+
+// Return the entry at p, following the symlinks and the hard links. Parent
+// directories of entries need no entry of their own, they are nil with a
+// true ok.
+func (t imageTree) resolve(p string) (*tar.Header, bool, error) {
+	links := 0
+	resolved := "/"
+	rest := strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+	for len(rest) != 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		cur := path.Join(resolved, name)
+		hdr, ok := t[cur]
+		if !ok {
+			if !t.hasChildren(cur) {
+				return nil, false, nil
+			}
+			resolved = cur
+			continue
+		}
+		for hdr.Typeflag == tar.TypeLink {
+			if links++; links > maxSymlinks {
+				return nil, false, fmt.Errorf("too many levels of links in %s", p)
+			}
+			target := path.Clean("/" + strings.TrimPrefix(path.Clean(hdr.Linkname), RootfsDir))
+			if hdr, ok = t[target]; !ok {
+				return nil, false, fmt.Errorf("hard link %s to missing %s", cur, target)
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			if links++; links > maxSymlinks {
+				return nil, false, fmt.Errorf("too many levels of symbolic links in %s", p)
+			}
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+			rest = append(strings.Split(strings.Trim(path.Clean(target), "/"), "/"), rest...)
+			resolved = "/"
+		case tar.TypeDir:
+			resolved = cur
+		default:
+			if len(rest) != 0 {
+				return nil, false, fmt.Errorf("%s is not a directory", cur)
+			}
+			return hdr, true, nil
+		}
+	}
+	return t[resolved], true, nil
+}
+
+func (t imageTree) hasChildren(dir string) bool {
+	for name := range t {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the binary a runtime would execute is in the image
+func (v *specValidator) checkBinary(field, bin string, tree imageTree) {
+	if !path.IsAbs(bin) {
+		v.errorf(aci.ManifestFile, field, "%q is not an absolute path", bin)
+		return
+	}
+	hdr, ok, err := tree.resolve(bin)
+	switch {
+	case err != nil:
+		v.errorf(aci.ManifestFile, field, "%v", err)
+	case !ok:
+		v.errorf(aci.ManifestFile, field, "%s is not in the image", bin)
+	case hdr == nil || hdr.Typeflag == tar.TypeDir:
+		v.errorf(aci.ManifestFile, field, "%s is a directory", bin)
+	case hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA:
+		v.errorf(aci.ManifestFile, field, "%s is not a regular file", bin)
+	case hdr.Mode&0111 == 0:
+		v.errorf(aci.ManifestFile, field, "%s is not executable", bin)
+	case strings.HasPrefix(path.Clean(bin), HooksDir+"/"):
+		// The hook wrappers oci2aci generates are run by HooksShell
+		v.checkBinary(field, HooksShell, tree)
+	}
+}
+
+func (v *specValidator) checkManifest(m *schema.ImageManifest, tree imageTree) {
+	app := m.App
+	if app == nil {
+		return
+	}
+	if len(app.Exec) != 0 {
+		v.checkBinary("/app/exec/0", app.Exec[0], tree)
+	}
+	for i, event := range app.EventHandlers {
+		field := fmt.Sprintf("/app/eventHandlers/%d/exec", i)
+		if len(event.Exec) == 0 {
+			v.errorf(aci.ManifestFile, field, "no command for event %s", event.Name)
+			continue
+		}
+		v.checkBinary(field+"/0", event.Exec[0], tree)
+	}
+
+	for i, isolator := range app.Isolators {
+		field := fmt.Sprintf("/app/isolators/%d", i)
+		if isolator.ValueRaw == nil {
+			v.errorf(aci.ManifestFile, field+"/value", "isolator %s has no value", isolator.Name)
+			continue
+		}
+		if value := isolator.Value(); value != nil {
+			if err := value.AssertValid(); err != nil {
+				v.errorf(aci.ManifestFile, field+"/value", "isolator %s: %v", isolator.Name, err)
+			}
+			continue
+		}
+		// The isolators oci2aci defines have no constructor in appc
+		var value interface{}
+		switch isolator.Name {
+		case SELinuxContextName:
+			value = new(IsolatorSELinuxContext)
+		case ReadOnlyRootfsName:
+			value = new(IsolatorReadOnlyRootfs)
+		default:
+			value = new(interface{})
+		}
+		if err := json.Unmarshal(*isolator.ValueRaw, value); err != nil {
+			v.errorf(aci.ManifestFile, field+"/value", "isolator %s: %v", isolator.Name, err)
+		}
+	}
+
+	names := map[types.ACName]int{}
+	paths := map[string]int{}
+	for i, mount := range app.MountPoints {
+		field := fmt.Sprintf("/app/mountPoints/%d", i)
+		if j, ok := names[mount.Name]; ok {
+			v.errorf(aci.ManifestFile, field+"/name", "duplicate mount point %s of /app/mountPoints/%d", mount.Name, j)
+		} else {
+			names[mount.Name] = i
+		}
+		p := path.Clean(mount.Path)
+		if j, ok := paths[p]; ok {
+			v.errorf(aci.ManifestFile, field+"/path", "path %s is also the one of /app/mountPoints/%d", mount.Path, j)
+		} else {
+			paths[p] = i
+		}
+
+		hdr, ok, err := tree.resolve(p)
+		switch {
+		case err != nil:
+			v.errorf(aci.ManifestFile, field+"/path", "%v", err)
+		case ok && hdr != nil && hdr.Typeflag != tar.TypeDir:
+			v.errorf(aci.ManifestFile, field+"/path", "path %s is a file of the image", mount.Path)
+		}
+	}
+}
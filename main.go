@@ -16,24 +16,163 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/huawei-openlab/oci2aci/convert"
 )
 
+// stringSlice is a flag which may be given several times
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 var (
-	flagDebug = flag.Bool("debug", false, "Enables debug messages")
-	flagName  = flag.String("name", "oci", "Specify ACName of aci manifest")
+	flagDebug       = flag.Bool("debug", false, "Enables debug messages")
+	flagName        = flag.String("name", "oci", "Specify ACName of aci manifest")
+	flagImage       = flag.String("image", "", "Image reference such as example.com/team/app:1.4.2, sets the name and version label of aci manifest")
+	flagCompress    = flag.Bool("compress", false, "Compress the aci image with gzip")
+	flagCompression = flag.String("compression", "", "Compress the aci image with \"gzip\" or \"xz\", or \"none\", instead of what -compress tells")
+	flagJobs        = flag.Int("jobs", 0, "Number of files read and blocks compressed at once while building the aci, the number of CPUs if 0")
+	flagStrict      = flag.Bool("strict", false, "Fail the conversion if a field is dropped or approximated in aci, except the ones the policy allows")
+	flagPolicy      = flag.String("policy", "", "YAML or JSON file with the fields a strict conversion may drop or approximate")
+	flagImageConfig = flag.String("image-config", "", "OCI or Docker image config the bundle was unpacked from, used for exposed ports and version")
+	flagPlatform    = flag.String("platform", "", "Platforms of an OCI image layout to convert as os/arch[/variant] separated by ',', all by default")
+	flagMetadata    = flag.String("metadata", "", "YAML or JSON file with labels and annotations to set, an empty value removes one")
+	flagProgress    = flag.Bool("progress", true, "Show a progress bar when stderr is a terminal")
+	flagReport      = flag.String("report", "", "Write the conversion report as JSON to the given file, \"-\" for stdout unless the image is streamed there, and print its summary")
+	flagBundle      = addBundleFlags(flag.CommandLine)
+	flagStash       = flag.String("stash", "", "Keep the original config.json and runtime.json in the aci as \"annotation\" or \"file\", to convert it back losslessly")
+	flagWhitelist   = flag.Bool("path-whitelist", false, "List the paths of the aci rootfs in the pathWhitelist of aci manifest")
+	flagStripSetID  = flag.Bool("strip-setid", false, "Clear the setuid and setgid bits of the files of the rootfs")
+	flagStripWW     = flag.Bool("strip-world-writable", false, "Clear the write permission of others on the files and the directories of the rootfs which are not sticky")
+	flagDedup       = flag.Bool("dedup", false, "Store the files of the rootfs with the same content, mode and owner once, as hard links")
+	flagPorts       stringSlice
+	flagLabels      stringSlice
+	flagAnnotations stringSlice
+	flagInclude     stringSlice
+	flagExclude     stringSlice
+)
+
+// Flags of what a bundle may hold, shared by the convert and validate
+// commands so that a bundle validates as it converts
+type bundleFlags struct {
+	external   *bool
+	extraFiles *string
+}
+
+func addBundleFlags(fs *flag.FlagSet) *bundleFlags {
+	return &bundleFlags{
+		external:   fs.Bool("allow-external-rootfs", false, "Allow root.path of config.json to name a directory outside of the bundle"),
+		extraFiles: fs.String("extra-files", "warn", "What to do with the files of the bundle besides config.json, runtime.json and the rootfs: \"reject\", \"ignore\", \"warn\" or \"embed\" them in the aci"),
+	}
+}
+
+func (f *bundleFlags) options() []convert.Option {
+	return []convert.Option{
+		convert.WithExtraFiles(convert.ExtraFiles(*f.extraFiles)),
+		convert.WithExternalRootfs(*f.external),
+	}
+}
+
+func init() {
+	flag.Var(&flagPorts, "port", "Add a port to the app as name:proto:port[-end][:socketActivated], may be given several times")
+	flag.Var(&flagLabels, "label", "Set a label as name=value, an empty value removes it, may be given several times")
+	flag.Var(&flagAnnotations, "annotation", "Set an annotation as name=value, an empty value removes it, may be given several times")
+	flag.Var(&flagInclude, "include", "Keep only the files of the rootfs matching a glob, a path such as /usr/bin/* or a base name such as *.so, may be given several times")
+	flag.Var(&flagExclude, "exclude", "Leave the files of the rootfs matching a glob out of the aci, a path such as /usr/share/doc or a base name such as *.pyc, may be given several times")
+}
+
+// Exit codes of the conversion, by the kind of error
+const (
+	exitError = iota + 1
+	exitUsage
+	exitBundle
+	exitSpec
+	exitUnsupported
+	exitBuild
 )
 
+// Exit code of a conversion interrupted by a signal, as shells report it,
+// or by the deadline of its context
+const exitCanceled = 130
+
+// Return the exit code of err, which may wrap the error of the conversion
+// as the one of a platform of an image layout does
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return exitCanceled
+	}
+	if errors.Is(err, convert.ErrDestination) {
+		return exitUsage
+	}
+	var (
+		bundleErr      *convert.BundleError
+		validationErr  *convert.ValidationError
+		specErr        *convert.SpecError
+		unsupportedErr *convert.UnsupportedFieldError
+		buildErr       *convert.BuildError
+	)
+	// A build wraps the ValidationError of the image it verifies
+	switch {
+	case errors.As(err, &buildErr):
+		return exitBuild
+	case errors.As(err, &bundleErr), errors.As(err, &validationErr):
+		return exitBundle
+	case errors.As(err, &specErr):
+		return exitSpec
+	case errors.As(err, &unsupportedErr):
+		return exitUnsupported
+	}
+	return exitError
+}
+
+// Write the reports as a JSON array to path, or stdout for "-", and their
+// summaries to stderr
+func writeReports(path string, reports []*convert.Report) error {
+	for _, r := range reports {
+		if err := r.WriteSummary(os.Stderr); err != nil {
+			return err
+		}
+	}
+	if reports == nil {
+		reports = []*convert.Report{}
+	}
+	data, err := json.MarshalIndent(reports, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "NAME:\n")
 	fmt.Fprintf(os.Stderr, "    oci2aci - Tool for conversion from oci to aci\n")
 
 	fmt.Fprintf(os.Stderr, "USAGE:\n")
-	fmt.Fprintf(os.Stderr, "    oci2aci [--debug] [arguments...]\n")
+	fmt.Fprintf(os.Stderr, "    oci2aci [flags] [arguments...]\n")
+	fmt.Fprintf(os.Stderr, "    oci2aci validate [-json] [-debug] [-extra-files ...] [-allow-external-rootfs] <bundle|aci>\n")
 
 	fmt.Fprintf(os.Stderr, "VERSION:\n")
 	fmt.Fprintf(os.Stderr, "    0.1.0\n")
@@ -43,18 +182,110 @@ func usage() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validateMain(os.Args[2:])
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
 
 	if len(args) < 1 || len(args) > 2 {
 		usage()
-		return
+		os.Exit(exitUsage)
+	}
+	// The report would be written in the middle of the image
+	if *flagReport == "-" && len(args) == 2 && args[1] == "-" {
+		fmt.Fprintf(os.Stderr, "Error: -report - writes to stdout, where the image is streamed\n")
+		os.Exit(exitUsage)
+	}
+
+	logger := logrus.StandardLogger()
+	if *flagDebug {
+		logger.Level = logrus.DebugLevel
+	}
+
+	opts := []convert.Option{
+		convert.WithLogger(logger),
+		convert.WithName(*flagName),
+		convert.WithStrict(*flagStrict),
+		convert.WithPolicyFile(*flagPolicy),
+		convert.WithPorts(flagPorts...),
+		convert.WithImageConfig(*flagImageConfig),
+		convert.WithLabels(flagLabels...),
+		convert.WithAnnotations(flagAnnotations...),
+		convert.WithMetadataFile(*flagMetadata),
+		convert.WithPlatforms(*flagPlatform),
+		convert.WithCompression(*flagCompress),
+		convert.WithJobs(*flagJobs),
+		convert.WithStash(convert.Stash(*flagStash)),
+		convert.WithInclude(flagInclude...),
+		convert.WithExclude(flagExclude...),
+		convert.WithPathWhitelist(*flagWhitelist),
+		convert.WithStripSetID(*flagStripSetID),
+		convert.WithStripWorldWritable(*flagStripWW),
+		convert.WithDedup(*flagDedup),
+	}
+	opts = append(opts, flagBundle.options()...)
+	// The compression format wins over the compress flag
+	if *flagCompression != "" {
+		opts = append(opts, convert.WithCompressionFormat(convert.Compression(*flagCompression)))
+	}
+	// The image reference wins over the name flag
+	if *flagImage != "" {
+		opts = append(opts, convert.WithImage(*flagImage))
+	}
+	var reports []*convert.Report
+	if *flagReport != "" {
+		opts = append(opts, convert.WithReport(func(r *convert.Report) {
+			reports = append(reports, r)
+		}))
+	}
+	// Debug messages would be garbled by the bar
+	var bar *progressBar
+	if *flagProgress && !*flagDebug && isTerminal(os.Stderr) {
+		bar = newProgressBar(os.Stderr)
+		opts = append(opts, convert.WithProgress(bar.Update))
+	}
+	c, err := convert.NewConverter(opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
 	}
 
-	if err := convert.RunOCI2ACI(args, *flagDebug, *flagName); err != nil {
+	var dstPath string
+	if len(args) == 2 {
+		dstPath = args[1]
+	}
+
+	// Interrupting the conversion removes its temporary files
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	// "-" streams the image to stdout, e.g. to pipe it to rkt fetch
+	if dstPath == "-" {
+		_, err = c.WriteImage(ctx, args[0], os.Stdout)
+	} else {
+		err = c.ConvertContext(ctx, args[0], dstPath)
+	}
+	if bar != nil {
+		bar.Finish()
+	}
+	if *flagReport != "" {
+		if err := writeReports(*flagReport, reports); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 
 	return
@@ -0,0 +1,121 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/huawei-openlab/oci2aci/convert"
+)
+
+const (
+	// Width of the bar in characters
+	progressWidth = 30
+	// Minimum interval between two redraws of the bar
+	progressInterval = 100 * time.Millisecond
+)
+
+// Progress bar of a conversion, redrawn in place on a terminal
+type progressBar struct {
+	w     io.Writer
+	last  time.Time
+	phase convert.Phase
+	width int
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w}
+}
+
+// Whether f is a terminal the bar can be redrawn on
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Update draws the event, events of the same phase arriving faster than
+// progressInterval are skipped
+func (b *progressBar) Update(p convert.Progress) {
+	now := time.Now()
+	if p.Phase == b.phase && now.Sub(b.last) < progressInterval {
+		return
+	}
+	b.last = now
+	b.phase = p.Phase
+
+	label := string(p.Phase)
+	if p.Platform != "" {
+		label = p.Platform + " " + label
+	}
+	var line string
+	switch {
+	case p.TotalBytes > 0:
+		line = fmt.Sprintf("%-20s %s %3d%% %d/%d files %s", label, bar(p.Bytes, p.TotalBytes),
+			p.Bytes*100/p.TotalBytes, p.Files, p.TotalFiles, formatBytes(p.Written))
+	case p.Files > 0:
+		line = fmt.Sprintf("%-20s %d files %s", label, p.Files, formatBytes(p.Bytes))
+	default:
+		line = label
+	}
+	b.draw(line)
+	if p.Phase == convert.PhaseDone {
+		b.Finish()
+	}
+}
+
+// Finish ends the line of the bar so further output starts on a new one
+func (b *progressBar) Finish() {
+	if b.width > 0 {
+		fmt.Fprintln(b.w)
+		b.width = 0
+	}
+}
+
+// Overwrite the previous line, padding it out if the new one is shorter
+func (b *progressBar) draw(line string) {
+	pad := ""
+	if len(line) < b.width {
+		pad = strings.Repeat(" ", b.width-len(line))
+	}
+	fmt.Fprintf(b.w, "\r%s%s", line, pad)
+	b.width = len(line)
+}
+
+func bar(n, total int64) string {
+	if n > total {
+		n = total
+	}
+	done := int(n * progressWidth / total)
+	return "[" + strings.Repeat("=", done) + strings.Repeat(" ", progressWidth-done) + "]"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
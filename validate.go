@@ -0,0 +1,107 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file defines the validate command of oci2aci
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/huawei-openlab/oci2aci/convert"
+)
+
+// Result of the validate command, as its JSON output
+type validateResult struct {
+	Path   string               `json:"path"`
+	Valid  bool                 `json:"valid"`
+	Errors []convert.FieldError `json:"errors"`
+}
+
+func validateUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "USAGE:\n")
+		fmt.Fprintf(os.Stderr, "    oci2aci validate [flags] <bundle|aci>\n")
+		fmt.Fprintf(os.Stderr, "FLAGS:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// Run the validate command with its arguments, and exit
+func validateMain(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = validateUsage(fs)
+	debug := fs.Bool("debug", false, "Enables debug messages")
+	jsonOutput := fs.Bool("json", false, "Print the result as JSON")
+	bundle := addBundleFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	path := fs.Arg(0)
+
+	logger := logrus.StandardLogger()
+	if *debug {
+		logger.Level = logrus.DebugLevel
+	}
+	c, err := convert.NewConverter(append(bundle.options(), convert.WithLogger(logger))...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	err = c.Validate(context.Background(), path)
+	res := validateResult{Path: path, Valid: err == nil, Errors: fieldErrors(err)}
+	if *jsonOutput {
+		data, err := json.MarshalIndent(res, "", "\t")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+		fmt.Printf("%s\n", data)
+	} else if res.Valid {
+		fmt.Printf("%s: valid\n", path)
+	} else {
+		fmt.Printf("%s: invalid\n", path)
+		for _, e := range res.Errors {
+			fmt.Printf("  %s\n", e)
+		}
+	}
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+	os.Exit(0)
+}
+
+// The errors of a validation with their location, if known
+func fieldErrors(err error) []convert.FieldError {
+	switch e := err.(type) {
+	case nil:
+		return []convert.FieldError{}
+	case *convert.ValidationError:
+		return e.Errors
+	case *convert.SpecError:
+		return []convert.FieldError{{File: e.File, Field: e.Field, Message: e.Err.Error()}}
+	case *convert.BundleError:
+		if verr, ok := e.Err.(*convert.ValidationError); ok {
+			return verr.Errors
+		}
+	}
+	return []convert.FieldError{{Message: err.Error()}}
+}